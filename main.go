@@ -1,52 +1,956 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
+	"github.com/BurntSushi/toml"
 	"github.com/gdamore/tcell/v2"
 	"github.com/pkg/sftp"
 	"github.com/rivo/tview"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v3"
 )
 
 var version = "dev"
 
 // --- Config ---
 type Config struct {
-	Host       string `json:"host"`
-	Port       int    `json:"port"`
-	Username   string `json:"username"`
-	RemotePath string `json:"remote_path"`
-	LocalPath  string `json:"local_path"`
-	LogFile    string `json:"log_file,omitempty"`
-	Password   string `json:"password,omitempty"`
+	Name                       string     `json:"name,omitempty"` // profile name, required in profiles
+	Host                       string     `json:"host"`
+	Port                       int        `json:"port,omitempty"` // when absent, Port from ~/.ssh/config or 22
+	Username                   string     `json:"username"`
+	RemotePath                 string     `json:"remote_path"`
+	LocalPath                  string     `json:"local_path"`
+	LogFile                    string     `json:"log_file,omitempty"`
+	Password                   string     `json:"password,omitempty" secret:"true"`
+	PasswordRef                string     `json:"password_ref,omitempty"`                         // where the password is stored instead, e.g. keyring:gofilesync/prod
+	SecretsFile                string     `json:"secrets_file,omitempty"`                         // encrypted secrets file for file: references
+	PrivateKeyPath             string     `json:"private_key_path,omitempty"`                     // RSA, ECDSA or Ed25519 key, tried before the password
+	PrivateKeyPassphrase       string     `json:"private_key_passphrase,omitempty" secret:"true"` // for an encrypted private key
+	PrivateKeyPassphraseRef    string     `json:"private_key_passphrase_ref,omitempty"`           // where the key passphrase is stored instead
+	Auth                       string     `json:"auth,omitempty"`                                 // "agent" to log in through ssh-agent first
+	KnownHostsFile             string     `json:"known_hosts_file,omitempty"`                     // gofilesync's own known_hosts, checked after ~/.ssh/known_hosts
+	HostKeyFingerprint         string     `json:"host_key_fingerprint,omitempty"`                 // pinned SHA256 fingerprint of the server key
+	JumpHosts                  []JumpHost `json:"jump_hosts,omitempty"`                           // bastions to tunnel through, in order
+	Proxy                      string     `json:"proxy,omitempty"`                                // socks5:// or http:// proxy for the TCP connection
+	TOTPSecret                 string     `json:"totp_secret,omitempty" secret:"true"`            // base32 secret answering one-time code prompts
+	TOTPSecretRef              string     `json:"totp_secret_ref,omitempty"`                      // where the TOTP secret is stored instead
+	KeyboardInteractiveCommand string     `json:"keyboard_interactive_command,omitempty"`         // shell command printing the answer to $GOFILESYNC_PROMPT
+	DebounceMs                 int        `json:"debounce_ms,omitempty"`                          // quiet period before a changed file is uploaded
+	NoRemoteDelete             bool       `json:"no_remote_delete,omitempty"`                     // keep remote files when they are deleted or renamed locally
+	Mode                       string     `json:"mode,omitempty"`                                 // push (default), pull or bidirectional
+	ConflictPolicy             string     `json:"conflict_policy,omitempty"`                      // newest (default), local, remote or keep-both
+	PollIntervalSec            int        `json:"poll_interval_sec,omitempty"`                    // how often the remote tree is checked outside push mode
+	DeleteLocal                bool       `json:"delete_local,omitempty"`                         // pull mode: delete local files that were removed remotely
+	KeepaliveSec               int        `json:"keepalive_sec,omitempty"`                        // interval between SSH keepalive requests
+	ReconnectMaxBackoffSec     int        `json:"reconnect_max_backoff_sec,omitempty"`            // upper bound for the wait between reconnect attempts
+	MaxConcurrentTransfers     int        `json:"max_concurrent_transfers,omitempty"`             // files uploaded or downloaded at once
+	Profiles                   []Config   `json:"profiles,omitempty"`                             // named syncs using the settings above as defaults
+
+	portSet bool // port was given, so 0 is an error rather than the default
+}
+
+// JumpHost is a bastion the connection to the server is tunnelled through.
+// Each one logs in with its own credentials; with none set, ssh-agent is used.
+type JumpHost struct {
+	Host                    string `json:"host"` // may be an alias from ~/.ssh/config
+	Port                    int    `json:"port,omitempty"`
+	Username                string `json:"username,omitempty"`
+	Password                string `json:"password,omitempty" secret:"true"`
+	PasswordRef             string `json:"password_ref,omitempty"`
+	PrivateKeyPath          string `json:"private_key_path,omitempty"`
+	PrivateKeyPassphrase    string `json:"private_key_passphrase,omitempty" secret:"true"`
+	PrivateKeyPassphraseRef string `json:"private_key_passphrase_ref,omitempty"`
+	Auth                    string `json:"auth,omitempty"`
+	HostKeyFingerprint      string `json:"host_key_fingerprint,omitempty"`
 }
 
-func loadConfig(configPath string) (*Config, error) {
+// config returns the connection settings for j, with the app's known_hosts
+// file and the proxy taken from cfg.
+func (j JumpHost) config(cfg *Config) *Config {
+	return &Config{
+		Host:                 j.Host,
+		Port:                 j.Port,
+		Username:             j.Username,
+		Password:             j.Password,
+		PrivateKeyPath:       j.PrivateKeyPath,
+		PrivateKeyPassphrase: j.PrivateKeyPassphrase,
+		Auth:                 j.Auth,
+		KnownHostsFile:       cfg.KnownHostsFile,
+		HostKeyFingerprint:   j.HostKeyFingerprint,
+		Proxy:                cfg.Proxy,
+	}
+}
+
+// Config file names: localConfigFile in the working directory,
+// configFileName in the user and system config directories, and
+// legacyConfigFile, which older versions read from the working directory.
+// The first two may also have any of configExtensions in place of .json.
+const (
+	localConfigFile  = ".gofilesync.json"
+	configFileName   = "gofilesync.json"
+	legacyConfigFile = "config.json"
+)
+
+// configExtensions are the config file formats, in the order they are
+// looked for in a directory.
+var configExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// Config file formats, as told apart by configFormat.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// configFormat returns the format of the config file at p, going by its
+// extension. Anything unrecognised is read as JSON.
+func configFormat(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	default:
+		return formatJSON
+	}
+}
+
+// configEnv names the variable that points at the config file.
+const configEnv = "GOFILESYNC_CONFIG"
+
+// findConfig returns the config file to use and whether it exists. A path
+// given with --config (explicit) or in $GOFILESYNC_CONFIG is used as is.
+// Otherwise the first existing file of configSearchPath is used, and when
+// there is none, ./.gofilesync.json, for setup to create.
+func findConfig(explicit string) (string, bool) {
+	if explicit == "" {
+		explicit = os.Getenv(configEnv)
+	}
+	if explicit != "" {
+		_, err := os.Stat(explicit)
+		return explicit, err == nil
+	}
+	for _, p := range configSearchPath() {
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return localConfigFile, false
+}
+
+// configSearchPath lists where a config is looked for when none is given:
+// the working directory, then the user config directory
+// ($XDG_CONFIG_HOME/gofilesync), then the system-wide one.
+func configSearchPath() []string {
+	var paths []string
+	add := func(p string) {
+		base := strings.TrimSuffix(p, ".json")
+		for _, ext := range configExtensions {
+			paths = append(paths, base+ext)
+		}
+	}
+	add(localConfigFile)
+	paths = append(paths, legacyConfigFile)
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir, _ = os.UserConfigDir()
+	}
+	if dir != "" {
+		add(filepath.Join(dir, "gofilesync", configFileName))
+	}
+	add(filepath.Join(systemConfigDir(), configFileName))
+	return paths
+}
+
+// systemConfigDir returns the directory of the system-wide config, which the
+// service reads.
+func systemConfigDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("ProgramData"), "gofilesync")
+	case "darwin":
+		return "/usr/local/etc/gofilesync"
+	default:
+		return "/etc/gofilesync"
+	}
+}
+
+// loadConfig reads the config file and returns the profiles in it, ready
+// to connect, or only the one called profile if that is not empty.
+// Top-level settings are defaults for every entry in profiles, which
+// override them key by key; a config without profiles is a single unnamed
+// one. overrides take precedence over both.
+func loadConfig(configPath, profile string, overrides []configOverride) ([]*Config, error) {
 	customPrint(fmt.Sprintf("Attempting to load config from: %s", configPath), DEBUG, false)
+	format := configFormat(configPath)
 	data, err := os.ReadFile(configPath)
+	if errors.Is(err, fs.ErrNotExist) && len(overrides) > 0 {
+		// Environment variables and flags can stand in for the file.
+		customPrint(fmt.Sprintf("No config file at %s, using environment and flags only", configPath), DEBUG, false)
+		data, format, err = []byte("{}"), formatJSON, nil
+	}
 	if err != nil {
 		customPrint(fmt.Sprintf("Error reading config file: %v", err), WARN, false)
 		return nil, err
 	}
 	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		customPrint(fmt.Sprintf("Error unmarshalling config JSON: %v", err), WARN, false)
-		return nil, err
+	data, errs, err := decodeConfig(data, format, &cfg)
+	if err != nil {
+		customPrint(fmt.Sprintf("Error unmarshalling config: %v", err), DEBUG, false)
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	cfg.portSet = hasKey(data, "port")
+	profiles := []*Config{&cfg}
+	if cfg.Name != "" && !profileNamePattern.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("name %q must be letters, digits, '.', '_' or '-'", cfg.Name)
+	}
+	if len(cfg.Profiles) > 0 {
+		if profiles, err = mergeProfiles(data); err != nil {
+			return nil, err
+		}
+	}
+	// Settings of the profiles left out must not stop the one asked for.
+	if profile != "" {
+		if profiles, err = selectProfile(profiles, profile); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range profiles {
+		if err := applyOverrides(p, overrides); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range profiles {
+		where := ""
+		if p.Name != "" {
+			where = "profile " + p.Name + ": "
+		}
+		if err := p.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("%s%w", where, err))
+		}
+		for _, err := range p.validate() {
+			errs = append(errs, fmt.Errorf("%s%w", where, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config %s:\n%w", configPath, errors.Join(errs...))
 	}
 	customPrint(fmt.Sprintf("Config loaded: %+v", cfg), DEBUG, false)
-	return &cfg, nil
+	return profiles, nil
+}
+
+// decodeConfig unmarshals config file data in format into cfg. Keys that
+// are not config fields are returned as unknown rather than failing the
+// decode, so that typos are reported along with every other problem. Errors
+// give the line and column they refer to. All formats share the JSON
+// schema: YAML and TOML are converted to JSON first, and that JSON is
+// returned for mergeProfiles.
+func decodeConfig(data []byte, format string, cfg *Config) ([]byte, []error, error) {
+	src := data
+	data, err := configToJSON(src, format)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err = dec.Decode(cfg)
+	if err == nil {
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, nil, errors.New("unexpected data after the config object")
+		}
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, nil, err
+		}
+		// The decoder stops at the first unknown field and does not say
+		// where it is, so find them all and look for each one.
+		keys := unknownKeys(v, reflect.TypeFor[Config]())
+		offsets := make(map[string]int, len(keys))
+		for _, key := range keys {
+			offsets[key] = len(src)
+			if loc := configKeyPattern(key, format).FindSubmatchIndex(src); loc != nil {
+				offsets[key] = loc[2]
+			}
+		}
+		slices.SortStableFunc(keys, func(a, b string) int { return offsets[a] - offsets[b] })
+		var unknown []error
+		for _, key := range keys {
+			unknown = append(unknown, atOffset(src, offsets[key], fmt.Errorf("unknown key %q", key)))
+		}
+		return data, unknown, nil
+	}
+	offset := -1
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) && format == formatJSON {
+		offset = int(syntaxErr.Offset)
+	} else if errors.As(err, &typeErr) {
+		if format == formatJSON {
+			offset = int(typeErr.Offset)
+		} else {
+			// Offsets are into the converted JSON; name the key instead.
+			key := typeErr.Field[strings.LastIndexByte(typeErr.Field, '.')+1:]
+			err = fmt.Errorf("%s: expected %s, found %s", typeErr.Field, typeErr.Type, typeErr.Value)
+			if loc := configKeyPattern(key, format).FindSubmatchIndex(src); loc != nil {
+				offset = loc[2]
+			}
+		}
+	}
+	if offset < 0 {
+		return nil, nil, err
+	}
+	return nil, nil, atOffset(src, offset, err)
+}
+
+// atOffset prefixes err with the line and column of offset in src, or
+// leaves it alone if offset is past the end.
+func atOffset(src []byte, offset int, err error) error {
+	if offset >= len(src) {
+		return err
+	}
+	before := src[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// unknownKeys returns, sorted and without repeats, the keys in the decoded
+// JSON object v that name no field of the struct type t, looking inside
+// nested objects and lists of them. Like encoding/json, it matches field
+// names without regard to case.
+func unknownKeys(v any, t reflect.Type) []string {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for key, val := range obj {
+		i := slices.IndexFunc(reflect.VisibleFields(t), func(f reflect.StructField) bool {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			return f.IsExported() && name != "-" && strings.EqualFold(name, key)
+		})
+		if i < 0 {
+			keys = append(keys, key)
+			continue
+		}
+		ft := reflect.VisibleFields(t)[i].Type
+		if ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct {
+			continue
+		}
+		switch val := val.(type) {
+		case map[string]any:
+			keys = append(keys, unknownKeys(val, ft)...)
+		case []any:
+			for _, item := range val {
+				keys = append(keys, unknownKeys(item, ft)...)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// configKeyPattern matches where key is set in a config file in format. Its
+// first group is the key, with quotes if it has them.
+func configKeyPattern(key, format string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(strconv.Quote(key))
+	switch format {
+	case formatYAML:
+		return regexp.MustCompile(`(?m)(?:^|[-{,])\s*(` + quoted + `|` + regexp.QuoteMeta(key) + `)\s*:`)
+	case formatTOML:
+		return regexp.MustCompile(`(?m)(?:^|[{,])\s*(` + quoted + `|` + regexp.QuoteMeta(key) + `)\s*=`)
+	default:
+		return regexp.MustCompile(`(` + quoted + `)\s*:`)
+	}
+}
+
+// configToJSON converts config file data in format to JSON. YAML and TOML
+// are decoded into plain maps and lists, so their keys are checked against
+// the JSON field names like those of a JSON file.
+func configToJSON(data []byte, format string) ([]byte, error) {
+	var v map[string]any
+	switch format {
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		if err := toml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	if v == nil {
+		v = map[string]any{}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot be read as a config: %w", err)
+	}
+	return data, nil
+}
+
+// encodeConfig renders v, a Config or a list of profiles, in format, with
+// keys named and left out as in JSON. YAML keeps the order of the Config
+// fields; TOML sorts keys, as its tables have to come after the plain keys
+// anyway.
+func encodeConfig(v any, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil || format == formatJSON {
+		return data, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := yamlNode(dec)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if format == formatYAML {
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(node); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), enc.Close()
+	}
+	var m map[string]any
+	if err := node.Decode(&m); err != nil {
+		return nil, err
+	}
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlNode reads the next JSON value from dec as a YAML node, keeping the
+// order of object keys. dec must use json.Number for numbers.
+func yamlNode(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		if t == '{' {
+			n.Kind = yaml.MappingNode
+		}
+		for dec.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key.(string)})
+			}
+			v, err := yamlNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, v)
+		}
+		_, err := dec.Token() // closing delimiter
+		return n, err
+	case json.Number:
+		tag := "!!int"
+		if _, err := t.Int64(); err != nil {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: t.String()}, nil
+	default:
+		n := &yaml.Node{}
+		return n, n.Encode(t)
+	}
+}
+
+// validate reports the mistakes in a resolved profile that would otherwise
+// only surface once syncing starts, one error per problem, each starting
+// with the key at fault.
+func (cfg *Config) validate() []error {
+	var errs []error
+	bad := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	if cfg.Host == "" {
+		bad("host", "is required")
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		bad("port", "%d is not between 1 and 65535", cfg.Port)
+	}
+	if cfg.LocalPath == "" {
+		bad("local_path", "is required")
+	} else if err := checkLocalDir(cfg.LocalPath); err != nil {
+		bad("local_path", "%v", err)
+	}
+	if err := checkRemotePath(cfg.RemotePath); err != nil {
+		bad("remote_path", "%v", err)
+	}
+	engine := &syncEngine{cfg: cfg}
+	if _, err := engine.mode(); err != nil {
+		bad("mode", "%v", err)
+	}
+	if _, err := engine.conflictPolicy(); err != nil {
+		bad("conflict_policy", "%v", err)
+	}
+	for _, n := range []struct {
+		key   string
+		value int
+	}{
+		{"debounce_ms", cfg.DebounceMs},
+		{"poll_interval_sec", cfg.PollIntervalSec},
+		{"keepalive_sec", cfg.KeepaliveSec},
+		{"reconnect_max_backoff_sec", cfg.ReconnectMaxBackoffSec},
+		{"max_concurrent_transfers", cfg.MaxConcurrentTransfers},
+	} {
+		if n.value < 0 {
+			bad(n.key, "must not be negative")
+		}
+	}
+	if cfg.Proxy != "" {
+		if _, err := parseProxyURL(cfg.Proxy); err != nil {
+			bad("proxy", "%v", err)
+		}
+	}
+	errs = append(errs, checkLogin("", cfg.Auth, cfg.PrivateKeyPath, cfg.HostKeyFingerprint)...)
+	for i, jump := range cfg.JumpHosts {
+		key := fmt.Sprintf("jump_hosts[%d].", i)
+		if jump.Host == "" {
+			bad(key+"host", "is required")
+		}
+		if jump.Port < 0 || jump.Port > 65535 {
+			bad(key+"port", "%d is not between 1 and 65535", jump.Port)
+		}
+		errs = append(errs, checkLogin(key, jump.Auth, jump.PrivateKeyPath, jump.HostKeyFingerprint)...)
+	}
+	return errs
+}
+
+// checkLogin validates the login settings shared by servers and jump hosts,
+// with prefix in front of each key.
+func checkLogin(prefix, auth, privateKeyPath, fingerprint string) []error {
+	var errs []error
+	if auth != "" && !strings.EqualFold(auth, authAgent) {
+		errs = append(errs, fmt.Errorf("%sauth: unknown method %q (expected %s or empty)", prefix, auth, authAgent))
+	}
+	if privateKeyPath != "" {
+		if _, err := os.Stat(expandHome(privateKeyPath)); err != nil {
+			errs = append(errs, fmt.Errorf("%sprivate_key_path: %w", prefix, err))
+		}
+	}
+	if fingerprint != "" {
+		sum, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(fingerprint, "SHA256:"), "="))
+		if err != nil || len(sum) != sha256.Size {
+			errs = append(errs, fmt.Errorf("%shost_key_fingerprint: %q is not a SHA256 fingerprint as printed by ssh-keygen -lf", prefix, fingerprint))
+		}
+	}
+	return errs
+}
+
+// checkLocalDir checks that p is a directory gofilesync can list.
+func checkLocalDir(p string) error {
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", p)
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", p)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("%s is not readable: %w", p, err)
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return fmt.Errorf("%s is not readable: %w", p, err)
+	}
+	return nil
+}
+
+// checkRemotePath checks that p is usable as an SFTP path: slash-separated,
+// and absolute or relative to the login directory.
+func checkRemotePath(p string) error {
+	switch {
+	case p == "":
+		return errors.New("is required")
+	case strings.Contains(p, `\`):
+		return fmt.Errorf("%s contains a backslash; SFTP paths use forward slashes", p)
+	case strings.ContainsFunc(p, unicode.IsControl):
+		return fmt.Errorf("%q contains control characters", p)
+	}
+	return nil
+}
+
+// profileNamePattern limits profile names to what is safe in a file name,
+// as each profile keeps its own state file.
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// mergeProfiles lays each entry of the profiles list in the config data
+// over the top-level settings. Only the keys a profile sets replace the
+// defaults, so a profile can also turn a default off with false or 0.
+func mergeProfiles(data []byte) ([]*Config, error) {
+	var file struct {
+		Profiles []json.RawMessage `json:"profiles"`
+	}
+	var defaults Config
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return nil, err
+	}
+	defaults.Name, defaults.Profiles = "", nil
+	base, err := json.Marshal(defaults)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []*Config
+	seen := make(map[string]bool)
+	for i, raw := range file.Profiles {
+		var own Config
+		if err := json.Unmarshal(raw, &own); err != nil {
+			return nil, fmt.Errorf("profile %d: %w", i+1, err)
+		}
+		if !profileNamePattern.MatchString(own.Name) {
+			return nil, fmt.Errorf("profile %d: name %q must be letters, digits, '.', '_' or '-'", i+1, own.Name)
+		}
+		if seen[own.Name] {
+			return nil, fmt.Errorf("duplicate profile name %q", own.Name)
+		}
+		seen[own.Name] = true
+		if len(own.Profiles) > 0 {
+			return nil, fmt.Errorf("profile %s: profiles cannot be nested", own.Name)
+		}
+		// Decoding into a fresh copy of the defaults keeps profiles from
+		// sharing slices such as jump_hosts.
+		p := &Config{}
+		if err := json.Unmarshal(base, p); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, p); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", own.Name, err)
+		}
+		p.portSet = hasKey(data, "port") || hasKey(raw, "port")
+		// The profile's own references replace default secrets.
+		for _, s := range p.secretRefs(&own) {
+			if s.ownRef != "" && s.own == "" {
+				*s.value = ""
+			}
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// hasKey reports whether the JSON object data sets key, which, as in
+// encoding/json, matches without regard to case.
+func hasKey(data []byte, key string) bool {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return false
+	}
+	for k := range obj {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve fills in what the config leaves to defaults or keeps elsewhere:
+// the port, and the secrets behind password_ref and the other *_ref keys.
+func (cfg *Config) resolve() error {
+	if cfg.Port == 0 && !cfg.portSet {
+		cfg.Port = defaultPort(cfg.Host)
+	}
+	var err error
+	for _, s := range cfg.secretRefs(cfg) {
+		if s.ref == "" {
+			continue
+		}
+		if *s.value != "" {
+			customPrint(fmt.Sprintf("Both %s and %s_ref are set; using %s_ref", s.key, s.key, s.key), WARN, false)
+		}
+		if *s.value, err = resolveSecret(cfg, s.ref); err != nil {
+			return err
+		}
+	}
+	for i := range cfg.JumpHosts {
+		jump := &cfg.JumpHosts[i]
+		if jump.PasswordRef != "" {
+			if jump.Password, err = resolveSecret(cfg, jump.PasswordRef); err != nil {
+				return err
+			}
+		}
+		if jump.PrivateKeyPassphraseRef != "" {
+			if jump.PrivateKeyPassphrase, err = resolveSecret(cfg, jump.PrivateKeyPassphraseRef); err != nil {
+				return err
+			}
+		}
+	}
+	registerSecrets(cfg)
+	return nil
+}
+
+// secretRef pairs a secret in a Config with the key that may hold a
+// reference to it instead.
+type secretRef struct {
+	key         string  // config key of the secret; the reference is key_ref
+	value       *string // the secret in the Config secretRefs was called on
+	ref         string  // its reference
+	own, ownRef string  // the secret and reference as set in other
+}
+
+// secretRefs lists the secrets of cfg that can be kept outside the config
+// file, with their values in other alongside.
+func (cfg *Config) secretRefs(other *Config) []secretRef {
+	return []secretRef{
+		{"password", &cfg.Password, cfg.PasswordRef, other.Password, other.PasswordRef},
+		{"private_key_passphrase", &cfg.PrivateKeyPassphrase, cfg.PrivateKeyPassphraseRef, other.PrivateKeyPassphrase, other.PrivateKeyPassphraseRef},
+		{"totp_secret", &cfg.TOTPSecret, cfg.TOTPSecretRef, other.TOTPSecret, other.TOTPSecretRef},
+	}
+}
+
+// effective returns a copy of cfg with the defaults the sync engine falls
+// back on filled in.
+func (cfg *Config) effective() Config {
+	c := *cfg
+	e := &syncEngine{cfg: cfg}
+	c.Mode, _ = e.mode()
+	c.ConflictPolicy, _ = e.conflictPolicy()
+	c.DebounceMs = int(e.debounce() / time.Millisecond)
+	c.PollIntervalSec = int(e.pollInterval() / time.Second)
+	c.KeepaliveSec = int(e.keepaliveInterval() / time.Second)
+	if c.ReconnectMaxBackoffSec <= 0 {
+		c.ReconnectMaxBackoffSec = int(defaultMaxBackoff / time.Second)
+	}
+	c.MaxConcurrentTransfers = e.maxTransfers()
+	return c
+}
+
+// redacted replaces secret values in log output.
+const redacted = "[REDACTED]"
+
+// masked returns a copy of c with every field tagged secret:"true", and the
+// password in the proxy URL, replaced by redacted.
+func (c Config) masked() Config {
+	secretFields(reflect.ValueOf(&c).Elem(), true, func(f reflect.Value) {
+		if f.String() != "" {
+			f.SetString(redacted)
+		}
+	})
+	if u, err := url.Parse(c.Proxy); err == nil {
+		c.Proxy = u.Redacted()
+	}
+	// secretFields has copied the profiles already.
+	for i := range c.Profiles {
+		c.Profiles[i] = c.Profiles[i].masked()
+	}
+	return c
+}
+
+// String formats c with its secrets masked, so that logging a Config with
+// %v or %+v never shows a password.
+func (c Config) String() string {
+	type plain Config // without the String method
+	return fmt.Sprintf("%+v", plain(c.masked()))
+}
+
+// GoString masks secrets for %#v like String does for %v.
+func (c Config) GoString() string {
+	return "Config" + c.String()
+}
+
+// secretFields calls fn for every string field tagged secret:"true" in the
+// struct v, descending into nested structs, pointers and slices. With detach
+// set, pointers and slices are copied on the way down, so that fn can modify
+// a shallow copy without touching the value it was copied from.
+func secretFields(v reflect.Value, detach bool, fn func(reflect.Value)) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if detach {
+			c := reflect.New(v.Elem().Type())
+			c.Elem().Set(v.Elem())
+			v.Set(c)
+		}
+		secretFields(v.Elem(), detach, fn)
+	case reflect.Slice:
+		if detach && !v.IsNil() {
+			c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(c, v)
+			v.Set(c)
+		}
+		for i := 0; i < v.Len(); i++ {
+			secretFields(v.Index(i), detach, fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if f.Tag.Get("secret") == "true" && f.Type.Kind() == reflect.String {
+				fn(v.Field(i))
+				continue
+			}
+			secretFields(v.Field(i), detach, fn)
+		}
+	}
+}
+
+// --- Overrides ---
+
+// envPrefix starts the environment variables that override config keys:
+// GOFILESYNC_REMOTE_PATH sets remote_path, and so on.
+const envPrefix = "GOFILESYNC_"
+
+// configOverride sets a config key from outside the config file, from the
+// environment variable or flag named by source.
+type configOverride struct {
+	key, source, value string
+}
+
+// overridable holds the Config fields that environment variables and flags
+// can set, by config key: all but name and profiles, which only make sense
+// in a file, and log_file, which is not used: the log file is chosen before
+// any config is read.
+var overridable = func() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeFor[Config]()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.IsExported() && key != "name" && key != "profiles" && key != "log_file" {
+			fields[key] = f
+		}
+	}
+	return fields
+}()
+
+// envOverrides returns the overrides set in the environment, by key.
+func envOverrides() []configOverride {
+	var overrides []configOverride
+	for key := range overridable {
+		name := envPrefix + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(name); ok {
+			overrides = append(overrides, configOverride{key, name, value})
+		}
+	}
+	slices.SortFunc(overrides, func(a, b configOverride) int { return strings.Compare(a.key, b.key) })
+	return overrides
+}
+
+// addOverrideFlags defines a flag on fs for every overridable key, named
+// after it with dashes (--remote-path), that appends to overrides. Flags for
+// true/false keys need no value.
+func addOverrideFlags(fs *flag.FlagSet, overrides *[]configOverride) {
+	for key, f := range overridable {
+		name := strings.ReplaceAll(key, "_", "-")
+		set := func(value string) error {
+			// Check the value now so that a bad one is reported as a
+			// usage error.
+			if err := setConfigField(&Config{}, key, value); err != nil {
+				return err
+			}
+			*overrides = append(*overrides, configOverride{key, "--" + name, value})
+			return nil
+		}
+		if f.Type.Kind() == reflect.Bool {
+			fs.BoolFunc(name, "Override the config key "+key, set)
+		} else {
+			fs.Func(name, "Override the config key "+key, set)
+		}
+	}
+}
+
+// applyOverrides sets the keys in overrides on cfg, later ones winning. A
+// secret given this way, such as password, replaces its reference from the
+// file (password_ref), unless that is overridden too.
+func applyOverrides(cfg *Config, overrides []configOverride) error {
+	for _, o := range overrides {
+		if err := setConfigField(cfg, o.key, o.value); err != nil {
+			return fmt.Errorf("%s: %w", o.source, err)
+		}
+		if o.key == "port" {
+			cfg.portSet = true
+		}
+		ref := o.key + "_ref"
+		if _, ok := overridable[ref]; ok && !slices.ContainsFunc(overrides, func(o configOverride) bool { return o.key == ref }) {
+			setConfigField(cfg, ref, "")
+		}
+	}
+	return nil
+}
+
+// setConfigField parses value into the field for key. Lists such as
+// jump_hosts take JSON.
+func setConfigField(cfg *Config, key, value string) error {
+	v := reflect.ValueOf(cfg).Elem().FieldByIndex(overridable[key].Index)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		v.SetBool(b)
+	default:
+		p := reflect.New(v.Type())
+		dec := json.NewDecoder(strings.NewReader(value))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(p.Interface()); err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+		v.Set(p.Elem())
+	}
+	return nil
 }
 
 // --- Logging ---
@@ -67,6 +971,84 @@ var (
 	logFilePath string
 )
 
+// secretValues holds the secrets that are scrubbed from every log line.
+var (
+	secretValuesMu sync.RWMutex
+	secretValues   []string
+)
+
+// minRedactLen is the shortest secret scrubbed from free text; masking
+// shorter ones would mangle ordinary words. Config.String masks all of them.
+const minRedactLen = 4
+
+// registerSecret makes s be masked in all log output from now on.
+func registerSecret(s string) {
+	if len(s) < minRedactLen {
+		return
+	}
+	secretValuesMu.Lock()
+	defer secretValuesMu.Unlock()
+	if slices.Contains(secretValues, s) {
+		return
+	}
+	secretValues = append(secretValues, s)
+	// Longest first, so that a secret containing another is masked whole.
+	slices.SortFunc(secretValues, func(a, b string) int { return len(b) - len(a) })
+}
+
+// registerSecrets registers the values of all secret fields of cfg.
+func registerSecrets(cfg *Config) {
+	secretFields(reflect.ValueOf(cfg).Elem(), false, func(f reflect.Value) { registerSecret(f.String()) })
+	if u, err := url.Parse(cfg.Proxy); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			registerSecret(password)
+		}
+	}
+}
+
+// redact masks every registered secret in s.
+func redact(s string) string {
+	secretValuesMu.RLock()
+	defer secretValuesMu.RUnlock()
+	for _, secret := range secretValues {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// redactingCore scrubs registered secrets from the message and string
+// fields of each entry before passing it to the wrapped core.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = redact(ent.Message)
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		if f.Type == zapcore.StringType {
+			f.String = redact(f.String)
+		}
+		out[i] = f
+	}
+	return out
+}
+
 func InitLogger(debug bool, filePath string, disableConsole bool) error {
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:     "time",
@@ -99,7 +1081,7 @@ func InitLogger(debug bool, filePath string, disableConsole bool) error {
 		core = zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), consoleSyncer, zapcore.DebugLevel)
 	}
 
-	zapLogger = zap.New(core)
+	zapLogger = zap.New(redactingCore{core})
 	return nil
 }
 
@@ -177,7 +1159,7 @@ func customPrint(message string, level LogLevel, skipConsole bool) {
 		)
 	}
 
-	logger := zap.New(core)
+	logger := zap.New(redactingCore{core})
 	defer logger.Sync()
 
 	switch level {
@@ -219,7 +1201,7 @@ func runTUISetup(configPath string) error {
 	}
 	form.AddTextView("", logMode, 40, 1, false, false)
 
-	var host, port, username, password, remotePath, localPath string
+	var host, port, username, password, privateKeyPath, keyPassphrase, proxyURL, remotePath, localPath string
 
 	// Helper to update input fields from file browsers
 	updateField := func(label, value string) {
@@ -236,32 +1218,214 @@ func runTUISetup(configPath string) error {
 	form.AddInputField("SFTP Port", "22", 6, nil, func(text string) { port = text })
 	form.AddInputField("SFTP Username", "", 20, nil, func(text string) { username = text })
 	form.AddPasswordField("SFTP Password", "", 20, '*', func(text string) { password = text })
+	// Where Save puts the password and key passphrase; only the plain-text
+	// option writes them into the config file itself.
+	passwordStores := []string{"OS keyring", "Encrypted file", "Config file (plain text)"}
+	passwordStore := 0
+	form.AddDropDown("Store Secrets In", passwordStores, passwordStore, func(_ string, index int) { passwordStore = index })
+	form.AddInputField("Private Key", "", 40, nil, func(text string) { privateKeyPath = text })
+	form.AddPasswordField("Key Passphrase", "", 20, '*', func(text string) { keyPassphrase = text })
+	form.AddInputField("Proxy (optional)", "", 40, nil, func(text string) { proxyURL = text })
+	form.AddButton("Browse Key", func() {
+		current := filepath.Dir(expandHome(privateKeyPath))
+		if privateKeyPath == "" {
+			current = expandHome("~/.ssh")
+			if _, err := os.Stat(current); err != nil {
+				current = expandHome("~")
+			}
+		}
+		browser := tview.NewTreeView()
+		root := tview.NewTreeNode(current).SetColor(tview.Styles.PrimaryTextColor)
+		browser.SetRoot(root).SetCurrentNode(root)
+		// Unlike the directory browsers this lists files too; the
+		// reference of a file node is its path, of a directory its path
+		// with a trailing separator.
+		addChildren := func(node *tview.TreeNode, path string) {
+			node.ClearChildren()
+			if node == browser.GetRoot() {
+				parent := filepath.Dir(path)
+				if parent != path {
+					parentNode := tview.NewTreeNode(".. (up)").SetReference(parent)
+					parentNode.SetColor(tview.Styles.TertiaryTextColor)
+					node.AddChild(parentNode)
+				}
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return
+			}
+			for _, f := range entries {
+				full := filepath.Join(path, f.Name())
+				if f.IsDir() {
+					child := tview.NewTreeNode(f.Name() + string(filepath.Separator)).SetReference(full + string(filepath.Separator))
+					child.SetColor(tview.Styles.SecondaryTextColor)
+					node.AddChild(child)
+				} else if !strings.HasSuffix(f.Name(), ".pub") {
+					node.AddChild(tview.NewTreeNode(f.Name()).SetReference(full))
+				}
+			}
+		}
+		addChildren(root, current)
+		browser.SetSelectedFunc(func(node *tview.TreeNode) {
+			ref, ok := node.GetReference().(string)
+			if !ok {
+				return
+			}
+			switch {
+			case node.GetText() == ".. (up)":
+				newRoot := tview.NewTreeNode(ref).SetColor(tview.Styles.PrimaryTextColor)
+				addChildren(newRoot, ref)
+				browser.SetRoot(newRoot).SetCurrentNode(newRoot)
+			case strings.HasSuffix(ref, string(filepath.Separator)):
+				if len(node.GetChildren()) == 0 {
+					addChildren(node, strings.TrimSuffix(ref, string(filepath.Separator)))
+				} else {
+					node.SetExpanded(!node.IsExpanded())
+				}
+			default:
+				privateKeyPath = ref
+				updateField("Private Key", ref)
+				app.SetRoot(form, true)
+			}
+		})
+		browser.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+			if event.Key() == tcell.KeyEsc {
+				app.SetRoot(form, true)
+				return nil
+			}
+			return event
+		})
+		instructions := tview.NewTextView().SetText("Navigate: ↑↓ arrows | Enter open dir / select key | Esc/Cancel").SetTextColor(tcell.ColorYellow)
+		flex := tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(instructions, 1, 0, false).
+			AddItem(browser, 0, 1, true)
+		app.SetRoot(flex, true)
+	})
 	form.AddInputField("Remote SFTP Path", "/", 40, nil, func(text string) { remotePath = text })
-	form.AddButton("Browse Remote", func() {
+	// tuiChallenge answers keyboard-interactive prompts, such as a one-time
+	// code, through a form. It runs on the connecting goroutine and waits
+	// for the user.
+	tuiChallenge := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			// Some servers send a round that only carries a message.
+			return nil, nil
+		}
+		answers := make([]string, len(questions))
+		ok := make(chan bool, 1)
+		// Only the first press counts; a blocking send for a later one
+		// would hang tview's event loop.
+		answer := func(v bool) {
+			select {
+			case ok <- v:
+			default:
+			}
+		}
+		app.QueueUpdateDraw(func() {
+			prompt := tview.NewForm().SetHorizontal(false)
+			if instruction != "" {
+				prompt.AddTextView("", instruction, 60, 2, true, false)
+			}
+			for i, q := range questions {
+				if echos[i] {
+					prompt.AddInputField(q, "", 20, nil, func(text string) { answers[i] = text })
+				} else {
+					prompt.AddPasswordField(q, "", 20, '*', func(text string) { answers[i] = text })
+				}
+			}
+			prompt.AddButton("OK", func() { answer(true) })
+			prompt.AddButton("Cancel", func() { answer(false) })
+			title := name
+			if title == "" {
+				title = "Authentication required"
+			}
+			prompt.SetBorder(true).SetTitle(title).SetTitleAlign(tview.AlignLeft)
+			app.SetRoot(prompt, true)
+		})
+		if !<-ok {
+			return nil, errors.New("authentication cancelled")
+		}
+		return answers, nil
+	}
+	// browseRemote is named so that it can run again once an unknown host
+	// key has been accepted. It connects in the background, so that the
+	// wizard can ask for keyboard-interactive answers meanwhile, and hands
+	// the result to showRemoteBrowser.
+	var browseRemote func()
+	var showRemoteBrowser func(client *sftp.Client, err error)
+	browseRemote = func() {
 		// Always fetch current values from form fields
 		hostField := form.GetFormItemByLabel("SFTP Host").(*tview.InputField)
 		portField := form.GetFormItemByLabel("SFTP Port").(*tview.InputField)
 		userField := form.GetFormItemByLabel("SFTP Username").(*tview.InputField)
 		passField := form.GetFormItemByLabel("SFTP Password").(*tview.InputField)
+		keyField := form.GetFormItemByLabel("Private Key").(*tview.InputField)
+		keyPassField := form.GetFormItemByLabel("Key Passphrase").(*tview.InputField)
+		proxyField := form.GetFormItemByLabel("Proxy (optional)").(*tview.InputField)
 		host = hostField.GetText()
 		port = portField.GetText()
 		username = userField.GetText()
 		password = passField.GetText()
-		if host == "" || port == "" || username == "" || password == "" {
-			modal := tview.NewModal().SetText("Please fill in SFTP Host, Port, Username, and Password first.").AddButtons([]string{"OK"})
+		privateKeyPath = keyField.GetText()
+		keyPassphrase = keyPassField.GetText()
+		proxyURL = proxyField.GetText()
+		// Without a password or key, ssh-agent and keyboard-interactive
+		// prompts can still log in. Port and username may come from
+		// ~/.ssh/config when Host is an alias there.
+		if host == "" {
+			modal := tview.NewModal().SetText("Please fill in SFTP Host first.").AddButtons([]string{"OK"})
 			modal.SetDoneFunc(func(_ int, _ string) { app.SetRoot(form, true) })
 			app.SetRoot(modal, true)
 			return
 		}
-		p, err := atoi(port), error(nil)
-		if p == 0 {
+		p := atoi(port)
+		if port != "" && p == 0 {
 			modal := tview.NewModal().SetText("Invalid port number.").AddButtons([]string{"OK"})
 			modal.SetDoneFunc(func(_ int, _ string) { app.SetRoot(form, true) })
 			app.SetRoot(modal, true)
 			return
 		}
 		customPrint("Connecting to SFTP for remote browse...", DEBUG, true)
-		client, err := connectSFTP(host, p, username, password)
+		cfg := &Config{
+			Host:                 host,
+			Port:                 p,
+			Username:             username,
+			Password:             password,
+			PrivateKeyPath:       privateKeyPath,
+			PrivateKeyPassphrase: keyPassphrase,
+			Proxy:                proxyURL,
+		}
+		registerSecrets(cfg)
+		app.SetRoot(tview.NewModal().SetText(fmt.Sprintf("Connecting to %s...", host)), true)
+		go func() {
+			client, err := connectSFTP(cfg, tuiChallenge)
+			app.QueueUpdateDraw(func() { showRemoteBrowser(client, err) })
+		}()
+	}
+	showRemoteBrowser = func(client *sftp.Client, err error) {
+		var unknown *unknownHostKeyError
+		if errors.As(err, &unknown) {
+			// Trust on first use: show the key and remember it if accepted,
+			// so that unattended runs can verify it later.
+			text := fmt.Sprintf("The authenticity of host %s can't be established.\n\n%s key fingerprint is\n%s\n\nTrust this host and save its key to %s?",
+				unknown.Host, unknown.Key.Type(), ssh.FingerprintSHA256(unknown.Key), unknown.KnownHosts)
+			modal := tview.NewModal().SetText(text).AddButtons([]string{"Trust", "Cancel"})
+			modal.SetDoneFunc(func(_ int, label string) {
+				if label != "Trust" {
+					customPrint(fmt.Sprintf("Host key for %s rejected by user", unknown.Host), INFO, true)
+					app.SetRoot(form, true)
+					return
+				}
+				if err := trustHostKey(unknown.KnownHosts, unknown.Host, unknown.Key); err != nil {
+					modal := tview.NewModal().SetText("Failed to save host key: " + err.Error()).AddButtons([]string{"OK"})
+					modal.SetDoneFunc(func(_ int, _ string) { app.SetRoot(form, true) })
+					app.SetRoot(modal, true)
+					return
+				}
+				browseRemote()
+			})
+			app.SetRoot(modal, true)
+			return
+		}
 		if err != nil {
 			modal := tview.NewModal().SetText("SFTP connection failed: " + err.Error()).AddButtons([]string{"OK"})
 			modal.SetDoneFunc(func(_ int, _ string) { app.SetRoot(form, true) })
@@ -383,7 +1547,8 @@ func runTUISetup(configPath string) error {
 			AddItem(instructions, 1, 0, false).
 			AddItem(browser, 0, 1, true)
 		app.SetRoot(flex, true)
-	})
+	}
+	form.AddButton("Browse Remote", browseRemote)
 	form.AddInputField("Local Directory", "", 40, nil, func(text string) { localPath = text })
 	form.AddButton("Browse Local", func() {
 		current := localPath
@@ -496,13 +1661,48 @@ func runTUISetup(configPath string) error {
 			Password:   password,
 			RemotePath: remotePath,
 			LocalPath:  localPath,
+
+			PrivateKeyPath:       privateKeyPath,
+			PrivateKeyPassphrase: keyPassphrase,
+			Proxy:                proxyURL,
+		}
+		registerSecrets(&cfg)
+		if passwordStore != len(passwordStores)-1 {
+			name := fmt.Sprintf("%s@%s", username, host)
+			for _, s := range []struct {
+				what, name string
+				value, ref *string
+			}{
+				{"password", name, &cfg.Password, &cfg.PasswordRef},
+				{"key passphrase", name + "/key-passphrase", &cfg.PrivateKeyPassphrase, &cfg.PrivateKeyPassphraseRef},
+			} {
+				if *s.value == "" {
+					continue
+				}
+				ref := "keyring:gofilesync/" + s.name
+				if passwordStore == 1 {
+					ref = "file:" + s.name
+				}
+				if err := storeSecret(&cfg, ref, *s.value); err != nil {
+					modal := tview.NewModal().SetText(fmt.Sprintf("Could not store the %s: %v\n\nChoose another place to store it.", s.what, err)).AddButtons([]string{"OK"})
+					modal.SetDoneFunc(func(_ int, _ string) { app.SetRoot(form, true) })
+					app.SetRoot(modal, true)
+					return
+				}
+				*s.ref, *s.value = ref, ""
+			}
 		}
 		if logLevel <= DEBUG {
 			fmt.Printf("[DEBUG] Saving config: %+v\n", cfg)
 		}
-		data, err := json.MarshalIndent(cfg, "", "  ")
+		data, err := encodeConfig(&cfg, configFormat(configPath))
 		if err != nil {
-			customPrint(fmt.Sprintf("[DEBUG] Error marshalling config to JSON: %v", err), WARN, true)
+			customPrint(fmt.Sprintf("[DEBUG] Error marshalling config: %v", err), WARN, true)
+		}
+		// --config or $GOFILESYNC_CONFIG may name a directory that does
+		// not exist yet.
+		if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+			customPrint(fmt.Sprintf("[DEBUG] Error creating config directory: %v", err), WARN, true)
 		}
 		err = os.WriteFile(configPath, data, 0600)
 		if err != nil {
@@ -538,12 +1738,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	configPath := "config.json"
-
 	// Define flags
+	configFlag := flag.String("config", "", "Path to the config file")
 	logLevelArg := flag.String("loglevel", "info", "Set log level (options: warn, info, debug, trace)")
 	logfileFlag := flag.Bool("logfile", false, "Enable logging to a file (auto-named)")
 	helpFlag := flag.Bool("help", false, "Show help message")
+	var flagOverrides []configOverride
+	addOverrideFlags(flag.CommandLine, &flagOverrides)
 
 	flag.Parse()
 
@@ -570,16 +1771,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	configPath, configFound := findConfig(*configFlag)
+	customPrint(fmt.Sprintf("Using config file %s (exists: %v)", configPath, configFound), DEBUG, false)
+
+	// Subcommands accept the override flags too, so the list is only
+	// complete once they have parsed theirs.
+	overrides := func() []configOverride {
+		return append(envOverrides(), flagOverrides...)
+	}
+
 	args := flag.Args()
 	cmd := ""
 	if len(args) < 1 {
-		if _, err := os.Stat(configPath); err == nil {
+		if configFound {
 			cmd = "start"
 			customPrint("Config file found, proceeding to start mode.", DEBUG, false)
+		} else if len(overrides()) > 0 {
+			cmd = "start"
+			customPrint("Config set in environment or flags, proceeding to start mode.", DEBUG, false)
 		} else {
 			cmd = "setup"
 			customPrint("Config file not found, entering setup mode.", DEBUG, false)
 		}
+		args = []string{cmd}
 	} else {
 		cmd = args[0]
 		customPrint(fmt.Sprintf("Command line argument detected: %s", cmd), DEBUG, false)
@@ -599,13 +1813,60 @@ func main() {
 			os.Exit(1)
 		}
 	case "start":
+		startFlags := flag.NewFlagSet("start", flag.ExitOnError)
+		profileName := startFlags.String("profile", "", "Run only the named profile")
+		addOverrideFlags(startFlags, &flagOverrides)
+		startFlags.Parse(args[1:])
 		customPrint("Loading config and starting sync...", DEBUG, false)
-		_, err := loadConfig(configPath)
+		profiles, err := loadConfig(configPath, *profileName, overrides())
 		if err != nil {
 			customPrint(fmt.Sprintf("Failed to load config: %v", err), WARN, false)
 			os.Exit(1)
 		}
-		customPrint("Starting folder-to-SFTP sync (not implemented in this stub)", INFO, false)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runProfiles(ctx, configPath, profiles); err != nil {
+			customPrint(fmt.Sprintf("Sync failed: %v", err), WARN, false)
+			os.Exit(1)
+		}
+	case "config":
+		if len(args) < 2 || (args[1] != "validate" && args[1] != "show") {
+			customPrint("Usage: gofilesync config validate | config show [--effective]", WARN, false)
+			os.Exit(1)
+		}
+		configFlags := flag.NewFlagSet("config "+args[1], flag.ExitOnError)
+		effective := false
+		if args[1] == "show" {
+			configFlags.BoolVar(&effective, "effective", false, "Show the merged settings in use")
+		}
+		addOverrideFlags(configFlags, &flagOverrides)
+		configFlags.Parse(args[2:])
+		if args[1] == "show" {
+			if err := runConfigShow(configPath, effective, overrides()); err != nil {
+				customPrint(err.Error(), WARN, false)
+				os.Exit(1)
+			}
+			break
+		}
+		profiles, err := loadConfig(configPath, "", overrides())
+		if err != nil {
+			customPrint(err.Error(), WARN, false)
+			os.Exit(1)
+		}
+		msg := configPath + " is valid"
+		if len(profiles) > 1 {
+			msg += fmt.Sprintf(" (%d profiles)", len(profiles))
+		}
+		customPrint(msg, INFO, false)
+	case "secret":
+		if len(args) != 3 || args[1] != "set" {
+			customPrint("Usage: gofilesync secret set <ref>", WARN, false)
+			os.Exit(1)
+		}
+		if err := runSecretSet(configPath, args[2], overrides()); err != nil {
+			customPrint(fmt.Sprintf("Failed to store secret: %v", err), WARN, false)
+			os.Exit(1)
+		}
 	case "stop":
 		customPrint("Stop command received.", DEBUG, false)
 	case "version":
@@ -618,17 +1879,136 @@ func main() {
 	}
 }
 
+// selectProfile returns just the profile called name.
+func selectProfile(profiles []*Config, name string) ([]*Config, error) {
+	if len(profiles) == 1 && profiles[0].Name == "" {
+		return nil, fmt.Errorf("no profile named %q: the config has no profiles", name)
+	}
+	var names []string
+	for _, p := range profiles {
+		if p.Name == name {
+			return []*Config{p}, nil
+		}
+		names = append(names, p.Name)
+	}
+	return nil, fmt.Errorf("no profile named %q in config (profiles: %s)", name, strings.Join(names, ", "))
+}
+
+// runConfigShow prints the config in the format of its file, with secrets
+// masked. Plain show prints the file's settings; effective shows what start
+// would use, with overrides and defaults applied and each profile complete.
+func runConfigShow(configPath string, effective bool, overrides []configOverride) error {
+	var shown any
+	if effective {
+		profiles, err := loadConfig(configPath, "", overrides)
+		if err != nil {
+			return err
+		}
+		var all []Config
+		for _, p := range profiles {
+			all = append(all, p.effective().masked())
+		}
+		shown = all[0]
+		if len(all) > 1 {
+			shown = struct {
+				Profiles []Config `json:"profiles"`
+			}{all}
+		}
+	} else {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return err
+		}
+		var cfg Config
+		_, unknown, err := decodeConfig(data, configFormat(configPath), &cfg)
+		if err == nil {
+			err = errors.Join(unknown...)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", configPath, err)
+		}
+		shown = cfg.masked()
+	}
+	data, err := encodeConfig(shown, configFormat(configPath))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(bytes.TrimRight(data, "\n"), '\n'))
+	return err
+}
+
+// runSecretSet reads a secret from the terminal without echo, or from the
+// first line of stdin when it is not a terminal, and stores it under ref.
+func runSecretSet(configPath, ref string, overrides []configOverride) error {
+	var secret string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Secret: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		secret = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read secret from stdin: %w", err)
+		}
+		secret = strings.TrimRight(line, "\r\n")
+	}
+	if secret == "" {
+		return errors.New("empty secret")
+	}
+	registerSecret(secret)
+	// Only Config.SecretsFile matters here; honour it if a config exists.
+	cfg := &Config{}
+	if data, err := os.ReadFile(configPath); err == nil {
+		if data, err = configToJSON(data, configFormat(configPath)); err == nil {
+			_ = json.Unmarshal(data, cfg)
+		}
+	}
+	_ = applyOverrides(cfg, overrides)
+	if err := storeSecret(cfg, ref, secret); err != nil {
+		return err
+	}
+	customPrint(fmt.Sprintf("Stored secret %s", ref), INFO, false)
+	return nil
+}
+
 func displayHelp() {
 	helpText := `Usage: gofilesync [options] [command]
 
 Options:
+  --config <path>      Config file to use (.json, .yaml, .yml or .toml).
+                       Default: $GOFILESYNC_CONFIG, else the first that exists
+                       of ./.gofilesync.json, ./config.json, and
+                       gofilesync/gofilesync.json in the user config
+                       directory and then in the system one (on Linux,
+                       $XDG_CONFIG_HOME and /etc; see the README for other
+                       systems), where each gofilesync.json may also be
+                       .yaml, .yml or .toml.
   --loglevel <level>   Set log level (options: warn, info, debug, trace). Default: info
   --logfile            Enable logging to a file (auto-named).
   --help               Show this help message.
+  --<key> <value>      Override a config key, with dashes for underscores,
+                       e.g. --host, --remote-path or --no-remote-delete. Takes
+                       precedence over $GOFILESYNC_<KEY> (e.g.
+                       $GOFILESYNC_REMOTE_PATH), which takes precedence over
+                       the config file. Also accepted after start and config.
 
 Commands:
   setup                Launch the setup wizard.
-  start                Start the folder-to-SFTP sync.
+  start                Start the folder-to-SFTP sync, running all profiles.
+  start --profile <name>
+                       Start only the named profile.
+  config validate      Check the config file and report every problem in it.
+                       start runs the same checks.
+  config show          Print the config file with secrets masked.
+  config show --effective
+                       Print the settings start would use, with environment
+                       and flag overrides and defaults applied.
+  secret set <ref>     Store a secret read from stdin, e.g. for password_ref
+                       keyring:gofilesync/prod or file:prod.
   stop                 Stop the running sync process.
   version              Display the application version.`
 	zapLogger.Info(helpText) // Replacing fmt.Println to avoid TUI clobbering
@@ -662,29 +2042,6 @@ func getDefaultLogFilePath(app, version string, isService bool) string {
 	return filepath.Join(cwd, makeAutoLogFileName(app, version))
 }
 
-func connectSFTP(host string, port int, user, pass string) (*sftp.Client, error) {
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(pass),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-	addr := fmt.Sprintf("%s:%d", host, port)
-	conn, err := ssh.Dial("tcp", addr, config)
-	if err != nil {
-		customPrint(fmt.Sprintf("SSH dial error: %v", err), DEBUG, true)
-		return nil, err
-	}
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		customPrint(fmt.Sprintf("SFTP client error: %v", err), DEBUG, true)
-		return nil, err
-	}
-	customPrint("SFTP connection established.", DEBUG, true)
-	return client, nil
-}
-
 func atoi(s string) int {
 	var i int
 	fmt.Sscanf(s, "%d", &i)
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes a config file named name into a new directory and
+// returns its path.
+func writeTestConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	writeTestFile(t, p, data)
+	return p
+}
+
+// An unknown key must not hide the problems after it.
+func TestLoadConfigListsUnknownKeysAndOtherProblems(t *testing.T) {
+	p := writeTestConfig(t, "gofilesync.yaml", `host: example.com
+prot: 22
+local_path: `+filepath.Join(os.TempDir(), "gofilesync-missing")+`
+remote_path: /srv
+profiles:
+  - name: a
+    mdoe: push
+`)
+	_, err := loadConfig(p, "", nil)
+	if err == nil {
+		t.Fatal("loadConfig succeeded")
+	}
+	for _, want := range []string{
+		`line 2, column 1: unknown key "prot"`,
+		`line 7, column 5: unknown key "mdoe"`,
+		"profile a: local_path:",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfigPort(t *testing.T) {
+	local := t.TempDir()
+	tests := []struct {
+		name, config string
+		want         int // 0 if the config is invalid
+	}{
+		{"absent", `{}`, 22},
+		{"given", `{"port": 2222}`, 2222},
+		{"explicit zero", `{"port": 0}`, 0},
+		{"inherited zero", `{"port": 0, "profiles": [{"name": "a"}]}`, 0},
+		{"profile overrides zero", `{"port": 0, "profiles": [{"name": "a", "port": 2222}]}`, 2222},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeTestConfig(t, "gofilesync.json", tt.config)
+			profiles, err := loadConfig(p, "", []configOverride{
+				{"host", "test", "sftp.invalid"},
+				{"local_path", "test", local},
+				{"remote_path", "test", "/srv"},
+			})
+			if tt.want == 0 {
+				if err == nil || !strings.Contains(err.Error(), "port: 0 is not between 1 and 65535") {
+					t.Errorf("loadConfig error = %v, want port out of range", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if got := profiles[0].Port; got != tt.want {
+				t.Errorf("port = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// A broken profile must not stop another one from being started on its own.
+func TestLoadConfigSelectsProfileBeforeValidating(t *testing.T) {
+	p := writeTestConfig(t, "gofilesync.json", `{
+  "host": "sftp.invalid",
+  "remote_path": "/srv",
+  "profiles": [
+    {"name": "photos", "local_path": `+strconv.Quote(t.TempDir())+`},
+    {"name": "broken", "local_path": "", "mode": "sideways"}
+  ]
+}`)
+	profiles, err := loadConfig(p, "photos", nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(profiles) != 1 || profiles[0].Name != "photos" {
+		t.Fatalf("loadConfig returned %d profiles, want only photos", len(profiles))
+	}
+	if _, err := loadConfig(p, "", nil); err == nil || !strings.Contains(err.Error(), "profile broken: ") {
+		t.Errorf("loadConfig of every profile error = %v, want one for profile broken", err)
+	}
+	if _, err := loadConfig(p, "videos", nil); err == nil || !strings.Contains(err.Error(), `no profile named "videos"`) {
+		t.Errorf("loadConfig of a missing profile error = %v", err)
+	}
+}
+
+func TestDecodeConfigErrorPosition(t *testing.T) {
+	tests := []struct {
+		name, format, data, want string
+	}{
+		{"json unknown key", formatJSON, "{\n  \"host\": \"a\",\n  \"prot\": 22\n}", `line 3, column 3: unknown key "prot"`},
+		{"json nested unknown key", formatJSON, "{\n  \"jump_hosts\": [\n    {\"hots\": \"b\"}\n  ]\n}", `line 3, column 6: unknown key "hots"`},
+		{"json type", formatJSON, "{\n  \"host\": \"a\",\n  \"port\": \"22\"\n}", "line 3, column 15: json: cannot unmarshal string"}, // just after the value
+		{"yaml unknown key", formatYAML, "host: a\nprot: 22\n", `line 2, column 1: unknown key "prot"`},
+		{"yaml nested unknown key", formatYAML, "host: a\nprofiles:\n  - name: b\n    mdoe: push\n", `line 4, column 5: unknown key "mdoe"`},
+		{"yaml type", formatYAML, "host: a\nport: twenty-two\n", "line 2, column 1: port: expected int, found string"},
+		{"toml unknown key", formatTOML, "host = \"a\"\nprot = 22\n", `line 2, column 1: unknown key "prot"`},
+		{"toml nested unknown key", formatTOML, "host = \"a\"\n\n[[profiles]]\nname = \"b\"\n  mdoe = \"push\"\n", `line 5, column 3: unknown key "mdoe"`},
+		{"toml type", formatTOML, "host = \"a\"\nport = \"22\"\n", "line 2, column 1: port: expected int, found string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			_, unknown, err := decodeConfig([]byte(tt.data), tt.format, &cfg)
+			if err == nil {
+				err = errors.Join(unknown...)
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("decodeConfig error = %v, want one starting %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Flags win over the environment, which wins over the file.
+func TestOverridePrecedence(t *testing.T) {
+	p := writeTestConfig(t, "gofilesync.json", `{
+  "host": "file.invalid",
+  "port": 2201,
+  "local_path": `+strconv.Quote(t.TempDir())+`,
+  "remote_path": "/srv"
+}`)
+	t.Setenv("GOFILESYNC_HOST", "env.invalid")
+	t.Setenv("GOFILESYNC_PORT", "2202")
+	var flagOverrides []configOverride
+	fs := flag.NewFlagSet("start", flag.ContinueOnError)
+	addOverrideFlags(fs, &flagOverrides)
+	if err := fs.Parse([]string{"--port", "2203"}); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := loadConfig(p, "", append(envOverrides(), flagOverrides...))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	cfg := profiles[0]
+	if cfg.Port != 2203 {
+		t.Errorf("port = %d, want 2203 from --port", cfg.Port)
+	}
+	if cfg.Host != "env.invalid" {
+		t.Errorf("host = %q, want env.invalid from GOFILESYNC_HOST", cfg.Host)
+	}
+	if cfg.RemotePath != "/srv" {
+		t.Errorf("remote_path = %q, want /srv from the file", cfg.RemotePath)
+	}
+}
+
+// A password given from outside the file replaces password_ref, so the
+// reference is not looked up.
+func TestOverridePasswordClearsRef(t *testing.T) {
+	p := writeTestConfig(t, "gofilesync.json", `{
+  "host": "sftp.invalid",
+  "local_path": `+strconv.Quote(t.TempDir())+`,
+  "remote_path": "/srv",
+  "password_ref": "nowhere:prod",
+  "private_key_passphrase_ref": "nowhere:key"
+}`)
+	profiles, err := loadConfig(p, "", []configOverride{
+		{"password", "GOFILESYNC_PASSWORD", "hunter2"},
+		{"private_key_passphrase", "--private-key-passphrase", "s3cret"},
+	})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	cfg := profiles[0]
+	if cfg.Password != "hunter2" || cfg.PasswordRef != "" {
+		t.Errorf("password, password_ref = %q, %q; want hunter2 and no reference", cfg.Password, cfg.PasswordRef)
+	}
+	if cfg.PrivateKeyPassphrase != "s3cret" || cfg.PrivateKeyPassphraseRef != "" {
+		t.Errorf("private_key_passphrase, private_key_passphrase_ref = %q, %q; want s3cret and no reference", cfg.PrivateKeyPassphrase, cfg.PrivateKeyPassphraseRef)
+	}
+
+	// Overriding the reference as well keeps it.
+	cfg = &Config{}
+	if err := applyOverrides(cfg, []configOverride{
+		{"password", "GOFILESYNC_PASSWORD", "hunter2"},
+		{"password_ref", "--password-ref", "keyring:gofilesync/prod"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PasswordRef != "keyring:gofilesync/prod" {
+		t.Errorf("password_ref = %q, want the overridden reference", cfg.PasswordRef)
+	}
+}
+
+func TestOverridableKeys(t *testing.T) {
+	for _, key := range []string{"host", "port", "password", "password_ref", "jump_hosts", "no_remote_delete"} {
+		if _, ok := overridable[key]; !ok {
+			t.Errorf("%s cannot be overridden", key)
+		}
+	}
+	for _, key := range []string{"name", "profiles", "log_file", ""} {
+		if _, ok := overridable[key]; ok {
+			t.Errorf("%q can be overridden", key)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+)
+
+// --- Secret Storage ---
+
+// A secret reference such as "keyring:gofilesync/prod" or "file:prod" names
+// a backend and an entry in it. Config.PasswordRef holds one so that the
+// password itself never has to be written to the config file.
+const (
+	secretKeyring = "keyring" // OS keyring: Secret Service, Keychain or Credential Manager
+	secretFile    = "file"    // secrets file encrypted with AES-256-GCM
+)
+
+// masterPassphraseEnv names the variable holding the secrets file passphrase.
+const masterPassphraseEnv = "GOFILESYNC_MASTER_PASSPHRASE"
+
+type secretStore interface {
+	get(name string) (string, error)
+	set(name, secret string) error
+}
+
+// secretStoreFor parses ref and returns its backend and entry name.
+func secretStoreFor(cfg *Config, ref string) (secretStore, string, error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	if !ok || name == "" {
+		return nil, "", fmt.Errorf("invalid secret reference %q (expected %s:<name> or %s:<name>)", ref, secretKeyring, secretFile)
+	}
+	switch scheme {
+	case secretKeyring:
+		return keyringStore{}, name, nil
+	case secretFile:
+		return &fileSecretStore{path: secretsFilePath(cfg)}, name, nil
+	default:
+		return nil, "", fmt.Errorf("unknown secret store %q in %q (expected %s or %s)", scheme, ref, secretKeyring, secretFile)
+	}
+}
+
+// resolveSecret returns the secret ref points to.
+func resolveSecret(cfg *Config, ref string) (string, error) {
+	store, name, err := secretStoreFor(cfg, ref)
+	if err != nil {
+		return "", err
+	}
+	secret, err := store.get(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %w", ref, err)
+	}
+	return secret, nil
+}
+
+// storeSecret saves secret under ref, replacing any previous value.
+func storeSecret(cfg *Config, ref, secret string) error {
+	store, name, err := secretStoreFor(cfg, ref)
+	if err != nil {
+		return err
+	}
+	if err := store.set(name, secret); err != nil {
+		return fmt.Errorf("failed to store secret %s: %w", ref, err)
+	}
+	customPrint(fmt.Sprintf("Stored secret %s", ref), DEBUG, true)
+	return nil
+}
+
+// keyringStore keeps secrets in the OS keyring. A name of the form
+// "service/account" maps onto the keyring's two-part key; a bare name is an
+// account under the "gofilesync" service.
+type keyringStore struct{}
+
+func (keyringStore) split(name string) (string, string) {
+	if service, account, ok := strings.Cut(name, "/"); ok {
+		return service, account
+	}
+	return "gofilesync", name
+}
+
+func (k keyringStore) get(name string) (string, error) {
+	service, account := k.split(name)
+	return keyring.Get(service, account)
+}
+
+func (k keyringStore) set(name, secret string) error {
+	service, account := k.split(name)
+	return keyring.Set(service, account, secret)
+}
+
+// secretsFilePath returns Config.SecretsFile, or secrets.enc in the user
+// config directory.
+func secretsFilePath(cfg *Config) string {
+	if cfg != nil && cfg.SecretsFile != "" {
+		return expandHome(cfg.SecretsFile)
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "gofilesync", "secrets.enc")
+}
+
+// Key sources for the secrets file.
+const (
+	kdfScrypt     = "scrypt"      // derived from the master passphrase
+	kdfMachineKey = "machine-key" // random key stored next to the file
+)
+
+// fileSecretStore keeps secrets in a JSON map encrypted with AES-256-GCM.
+// The key is derived with scrypt from $GOFILESYNC_MASTER_PASSPHRASE or, when
+// the file is created without one, is a random machine key in a 0600 file
+// beside it. The latter only protects against the secrets file being copied
+// on its own, but needs nobody to type a passphrase.
+type fileSecretStore struct {
+	path string
+}
+
+type secretsFile struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt,omitempty"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func (f *fileSecretStore) get(name string) (string, error) {
+	secrets, _, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	secret, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("no secret %q in %s", name, f.path)
+	}
+	return secret, nil
+}
+
+func (f *fileSecretStore) set(name, secret string) error {
+	secrets, kdf, err := f.load()
+	if errors.Is(err, fs.ErrNotExist) {
+		secrets, kdf = make(map[string]string), kdfMachineKey
+		if os.Getenv(masterPassphraseEnv) != "" {
+			kdf = kdfScrypt
+		}
+	} else if err != nil {
+		return err
+	}
+	secrets[name] = secret
+	return f.save(secrets, kdf)
+}
+
+func (f *fileSecretStore) load() (map[string]string, string, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, "", err
+	}
+	var file secretsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s: %w", f.path, err)
+	}
+	gcm, err := f.cipher(file.KDF, file.Salt, false)
+	if err != nil {
+		return nil, "", err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, []byte(file.KDF))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt %s: wrong passphrase or key, or the file is corrupt", f.path)
+	}
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, "", fmt.Errorf("failed to parse decrypted %s: %w", f.path, err)
+	}
+	return secrets, file.KDF, nil
+}
+
+func (f *fileSecretStore) save(secrets map[string]string, kdf string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	file := secretsFile{KDF: kdf}
+	if kdf == kdfScrypt {
+		file.Salt = make([]byte, 16)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return err
+		}
+	}
+	gcm, err := f.cipher(kdf, file.Salt, true)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, []byte(kdf))
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// cipher returns the AES-GCM cipher for the given key source. create allows
+// a missing machine key to be generated.
+func (f *fileSecretStore) cipher(kdf string, salt []byte, create bool) (cipher.AEAD, error) {
+	var key []byte
+	switch kdf {
+	case kdfScrypt:
+		passphrase := os.Getenv(masterPassphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is protected by a master passphrase; set %s", f.path, masterPassphraseEnv)
+		}
+		var err error
+		if key, err = scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	case kdfMachineKey:
+		var err error
+		if key, err = f.machineKey(create); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown key derivation %q in %s", kdf, f.path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// machineKey reads the random key kept next to the secrets file, generating
+// it first if create is set.
+func (f *fileSecretStore) machineKey(create bool) ([]byte, error) {
+	p := filepath.Join(filepath.Dir(f.path), "machine.key")
+	key, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(p, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write machine key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read machine key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("machine key %s is corrupt", p)
+	}
+	return key, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSecretStoreRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		kdf, passphrase string
+	}{
+		{kdfScrypt, "correct horse battery staple"},
+		{kdfMachineKey, ""},
+	} {
+		t.Run(tt.kdf, func(t *testing.T) {
+			t.Setenv(masterPassphraseEnv, tt.passphrase)
+			cfg := &Config{SecretsFile: filepath.Join(t.TempDir(), "secrets.enc")}
+			secrets := map[string]string{"prod": "hunter2", "prod/key-passphrase": "s3cret"}
+			for name, secret := range secrets {
+				if err := storeSecret(cfg, "file:"+name, secret); err != nil {
+					t.Fatalf("storeSecret(%s): %v", name, err)
+				}
+			}
+			for name, want := range secrets {
+				got, err := resolveSecret(cfg, "file:"+name)
+				if err != nil {
+					t.Fatalf("resolveSecret(%s): %v", name, err)
+				}
+				if got != want {
+					t.Errorf("resolveSecret(%s) = %q, want %q", name, got, want)
+				}
+			}
+			if _, err := resolveSecret(cfg, "file:staging"); err == nil {
+				t.Error("resolveSecret of a missing name succeeded")
+			}
+
+			data, err := os.ReadFile(cfg.SecretsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var file secretsFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				t.Fatal(err)
+			}
+			if file.KDF != tt.kdf {
+				t.Errorf("kdf = %q, want %q", file.KDF, tt.kdf)
+			}
+			if strings.Contains(string(data), "hunter2") {
+				t.Error("secrets file holds a secret in the clear")
+			}
+		})
+	}
+}
+
+func TestFileSecretStoreWrongPassphrase(t *testing.T) {
+	cfg := &Config{SecretsFile: filepath.Join(t.TempDir(), "secrets.enc")}
+	t.Setenv(masterPassphraseEnv, "correct horse battery staple")
+	if err := storeSecret(cfg, "file:prod", "hunter2"); err != nil {
+		t.Fatalf("storeSecret: %v", err)
+	}
+
+	t.Setenv(masterPassphraseEnv, "incorrect horse")
+	_, err := resolveSecret(cfg, "file:prod")
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("resolveSecret with the wrong passphrase error = %v, want a decryption failure", err)
+	}
+	if err := storeSecret(cfg, "file:staging", "x"); err == nil {
+		t.Error("storeSecret with the wrong passphrase succeeded")
+	}
+
+	t.Setenv(masterPassphraseEnv, "")
+	if _, err := resolveSecret(cfg, "file:prod"); err == nil || !strings.Contains(err.Error(), masterPassphraseEnv) {
+		t.Errorf("resolveSecret without a passphrase error = %v, want one naming %s", err, masterPassphraseEnv)
+	}
+}
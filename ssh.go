@@ -0,0 +1,844 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// --- SSH Connection ---
+
+// sshDialTimeout bounds connecting to and handshaking with the SSH server.
+const sshDialTimeout = 30 * time.Second
+
+// connectSFTP opens an SFTP session. challenge answers keyboard-interactive
+// prompts; when nil they are answered from the config as in dialSSH.
+func connectSFTP(cfg *Config, challenge ssh.KeyboardInteractiveChallenge) (*sftp.Client, error) {
+	conn, err := dialSSH(cfg, challenge)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		customPrint(fmt.Sprintf("SFTP client error: %v", err), DEBUG, true)
+		return nil, err
+	}
+	customPrint("SFTP connection established.", DEBUG, true)
+	return client, nil
+}
+
+// dialSSH opens the SSH connection that SFTP sessions run over, through its
+// jump hosts if it has any; they are disconnected along with it. Unless
+// challenge is given, keyboard-interactive prompts are answered without a
+// user: see configChallenge.
+func dialSSH(cfg *Config, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Client, error) {
+	var jumps jumpChain
+	client, err := jumps.dial(cfg, challenge)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		client.Wait()
+		jumps.close()
+	}()
+	return client, nil
+}
+
+// jumpProbeTimeout bounds the check that a kept jump host chain still works.
+const jumpProbeTimeout = 10 * time.Second
+
+// jumpChain keeps the connections to a server's jump hosts open, so that
+// reconnecting to the server does not mean logging in to every bastion
+// again. The zero value is ready to use.
+type jumpChain struct {
+	mu   sync.Mutex
+	key  string        // the hops the chain was built for
+	hops []*ssh.Client // one per jump host, in order
+}
+
+// dial connects to the server cfg describes, tunnelled through its jump
+// hosts: Config.JumpHosts, or else the ProxyJump from ~/.ssh/config. The
+// chain left from an earlier dial is reused while it still answers.
+func (j *jumpChain) dial(cfg *Config, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Client, error) {
+	host := resolveSSHHost(cfg)
+	hops := jumpHosts(host)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var key []string
+	for _, hop := range hops {
+		key = append(key, fmt.Sprintf("%s@%s:%d", hop.cfg.Username, hop.cfg.Host, hop.cfg.Port))
+	}
+	if len(j.hops) > 0 && (j.key != strings.Join(key, ",") || !sshAlive(j.hops[len(j.hops)-1])) {
+		j.closeLocked()
+	}
+	if len(hops) == 0 {
+		return dialHost(host, challenge, nil)
+	}
+	if len(j.hops) > 0 {
+		customPrint(fmt.Sprintf("Reusing jump host connection to %s", key[len(key)-1]), DEBUG, true)
+	} else {
+		for _, hop := range hops {
+			c := hop.cfg
+			customPrint(fmt.Sprintf("Connecting through jump host %s@%s:%d", c.Username, c.Host, c.Port), DEBUG, true)
+			client, err := dialHost(hop, challenge, j.last())
+			if err != nil {
+				j.closeLocked()
+				return nil, fmt.Errorf("failed to connect to jump host %s:%d: %w", c.Host, c.Port, err)
+			}
+			j.hops = append(j.hops, client)
+		}
+		j.key = strings.Join(key, ",")
+	}
+	return dialHost(host, challenge, j.last())
+}
+
+// last returns the connection to the final jump host, or nil.
+func (j *jumpChain) last() *ssh.Client {
+	if len(j.hops) == 0 {
+		return nil
+	}
+	return j.hops[len(j.hops)-1]
+}
+
+// close disconnects from all jump hosts.
+func (j *jumpChain) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closeLocked()
+}
+
+func (j *jumpChain) closeLocked() {
+	for i := len(j.hops) - 1; i >= 0; i-- {
+		j.hops[i].Close()
+	}
+	j.hops, j.key = nil, ""
+}
+
+// sshAlive reports whether conn still answers a keepalive request.
+func sshAlive(conn *ssh.Client) bool {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-time.After(jumpProbeTimeout):
+		return false
+	}
+}
+
+// jumpHosts returns the hops to connect to host through. Config.JumpHosts
+// take precedence over ProxyJump like ssh -J does. ProxyJump hops log in
+// with their own ~/.ssh/config settings, falling back to ssh-agent or the
+// server's private key; the server's password is only ever sent to the
+// server itself.
+func jumpHosts(host sshHost) []sshHost {
+	cfg := host.cfg
+	var hops []sshHost
+	if len(cfg.JumpHosts) > 0 {
+		for _, jump := range cfg.JumpHosts {
+			hops = append(hops, resolveSSHHost(jump.config(cfg)))
+		}
+		return hops
+	}
+	if host.proxyJump == "" {
+		return nil
+	}
+	for _, spec := range strings.Split(host.proxyJump, ",") {
+		hop := resolveSSHHost(jumpHostConfig(cfg, strings.TrimSpace(spec)))
+		if hop.cfg.PrivateKeyPath == "" {
+			hop.cfg.PrivateKeyPath = cfg.PrivateKeyPath
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// jumpHostConfig returns the config for a ProxyJump hop given as
+// [user@]host[:port], optionally prefixed with ssh://.
+func jumpHostConfig(cfg *Config, spec string) *Config {
+	hop := &Config{
+		Auth:                 cfg.Auth,
+		PrivateKeyPassphrase: cfg.PrivateKeyPassphrase,
+		KnownHostsFile:       cfg.KnownHostsFile,
+		Proxy:                cfg.Proxy,
+	}
+	spec = strings.TrimPrefix(spec, "ssh://")
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		hop.Username, spec = spec[:i], spec[i+1:]
+	}
+	hop.Host = spec
+	if host, port, err := net.SplitHostPort(spec); err == nil {
+		hop.Host, hop.Port = host, atoi(port)
+	}
+	return hop
+}
+
+// dialHost connects and logs in to host, directly or, when via is given,
+// through that connection.
+func dialHost(host sshHost, challenge ssh.KeyboardInteractiveChallenge, via *ssh.Client) (*ssh.Client, error) {
+	cfg := host.cfg
+	auth, closeAuth, err := authMethods(cfg, challenge)
+	if err != nil {
+		return nil, err
+	}
+	// The agent is only needed while logging in.
+	defer closeAuth()
+	addr := net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port))
+	hostKeyCallback, hostKeyAlgorithms, err := hostKeyVerifier(cfg, addr, host.knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:              cfg.Username,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+	}
+	var netConn net.Conn
+	if via != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sshDialTimeout)
+		netConn, err = via.DialContext(ctx, "tcp", addr)
+		cancel()
+	} else {
+		netConn, err = dialTCP(cfg, addr)
+	}
+	if err != nil {
+		customPrint(fmt.Sprintf("SSH dial error: %v", err), DEBUG, true)
+		return nil, err
+	}
+	// ssh.Dial only bounds the TCP connect; a server that accepts and then
+	// stalls would otherwise hang the handshake forever.
+	netConn.SetDeadline(time.Now().Add(sshDialTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if err != nil {
+		netConn.Close()
+		customPrint(fmt.Sprintf("SSH handshake error: %v", err), DEBUG, true)
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialTCP opens the TCP connection to addr that SSH runs over, through
+// Config.Proxy if one is set: a SOCKS5 proxy (socks5:// or socks5h://, the
+// proxy resolves the name either way) or an HTTP proxy that supports
+// CONNECT (http://). Credentials for either go in the URL as user:password@.
+func dialTCP(cfg *Config, addr string) (net.Conn, error) {
+	if cfg.Proxy == "" {
+		return net.DialTimeout("tcp", addr, sshDialTimeout)
+	}
+	u, err := parseProxyURL(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	customPrint(fmt.Sprintf("Connecting to %s through proxy %s", addr, u.Redacted()), DEBUG, true)
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", proxyHostPort(u, "1080"), auth, &net.Dialer{Timeout: sshDialTimeout})
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sshDialTimeout)
+		defer cancel()
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS5 proxy %s: %w", u.Host, err)
+		}
+		return conn, nil
+	default:
+		return dialHTTPConnect(u, addr)
+	}
+}
+
+// parseProxyURL parses Config.Proxy and checks that its scheme is supported.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		// url.Error repeats the URL, password included.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected socks5 or http)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL %s has no host", u.Redacted())
+	}
+	return u, nil
+}
+
+// dialHTTPConnect opens a tunnel to addr through the HTTP proxy at u with a
+// CONNECT request.
+func dialHTTPConnect(u *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyHostPort(u, "80"), sshDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(sshDialTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", u.Host, err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", u.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused CONNECT to %s: %s", u.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// The server's SSH banner may already sit in r behind the response.
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn reads through r, which wraps Conn and may hold data already.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// proxyHostPort returns the proxy's address from u, with defaultPort when u
+// names none.
+func proxyHostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// authAgent selects ssh-agent authentication in Config.Auth.
+const authAgent = "agent"
+
+// authMethods returns the configured ways to log in, in the order they are
+// offered to the server: ssh-agent when Config.Auth selects it, the private
+// key, the password, then keyboard-interactive. The server moves on to the
+// next method when one is rejected, and servers that require two factors
+// ask for a second one after the first succeeds. With neither a key nor a
+// password configured the agent is used anyway. The returned func releases
+// the agent connection.
+func authMethods(cfg *Config, challenge ssh.KeyboardInteractiveChallenge) ([]ssh.AuthMethod, func(), error) {
+	useAgent := false
+	switch strings.ToLower(cfg.Auth) {
+	case "":
+		useAgent = cfg.PrivateKeyPath == "" && cfg.Password == ""
+	case authAgent:
+		useAgent = true
+	default:
+		return nil, nil, fmt.Errorf("unknown auth method %q (expected %s or empty)", cfg.Auth, authAgent)
+	}
+
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+	var agentErr error
+	if useAgent {
+		client, conn, err := dialAgent()
+		if err != nil {
+			agentErr = err
+		} else {
+			methods = append(methods, ssh.PublicKeysCallback(client.Signers))
+			closeAgent = func() { conn.Close() }
+		}
+	}
+	if cfg.PrivateKeyPath != "" {
+		signer, err := loadPrivateKey(cfg.PrivateKeyPath, cfg.PrivateKeyPassphrase)
+		if err != nil {
+			closeAgent()
+			return nil, nil, err
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		methods = append(methods, ssh.Password(cfg.Password))
+	}
+	if challenge == nil && (cfg.Password != "" || cfg.TOTPSecret != "" || cfg.KeyboardInteractiveCommand != "") {
+		challenge = configChallenge(cfg)
+	}
+	if challenge != nil {
+		methods = append(methods, ssh.KeyboardInteractive(challenge))
+	}
+	if len(methods) == 0 {
+		if agentErr != nil {
+			return nil, nil, fmt.Errorf("no authentication configured and ssh-agent unavailable: %w", agentErr)
+		}
+		return nil, nil, fmt.Errorf("no authentication configured: set password or private_key_path")
+	}
+	if agentErr != nil {
+		customPrint(fmt.Sprintf("Skipping ssh-agent: %v", agentErr), WARN, false)
+	}
+	return methods, closeAgent, nil
+}
+
+// dialAgent connects to the ssh-agent listening on SSH_AUTH_SOCK.
+func dialAgent() (agent.ExtendedAgent, net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// --- OpenSSH Config ---
+
+// sshHost is a server to connect to, with its ~/.ssh/config entry applied.
+type sshHost struct {
+	cfg        *Config  // copy with Host replaced by HostName and the rest filled in
+	knownHosts []string // UserKnownHostsFile, checked instead of ~/.ssh/known_hosts
+	proxyJump  string   // comma-separated hops to connect through
+}
+
+// resolveSSHHost applies what ~/.ssh/config and /etc/ssh/ssh_config say
+// about cfg.Host, so that Host can be an alias like with ssh. As with
+// options on the ssh command line, settings in gofilesync's config win; the
+// ssh config supplies HostName, Port, User, IdentityFile, ProxyJump and
+// UserKnownHostsFile. The files are read again on every connection, so
+// edits to them apply on the next reconnect.
+func resolveSSHHost(cfg *Config) sshHost {
+	c := *cfg
+	h := sshHost{cfg: &c}
+	get, getAll := sshConfigLookup(cfg.Host)
+	if v := get("HostName"); v != "" {
+		c.Host = strings.ReplaceAll(v, "%h", cfg.Host)
+	}
+	if c.Port == 0 {
+		c.Port = sshPort(get)
+	}
+	if c.Username == "" {
+		c.Username = get("User")
+	}
+	if c.Username == "" {
+		c.Username = localUsername()
+	}
+	tokens := sshTokens(&c, cfg.Host)
+	if c.PrivateKeyPath == "" {
+		for _, f := range getAll("IdentityFile") {
+			f = expandHome(tokens.Replace(f))
+			if _, err := os.Stat(f); err != nil {
+				continue
+			}
+			// Keys that need a passphrase gofilesync does not have are
+			// left to ssh-agent, as ssh would prompt for them.
+			if _, err := loadPrivateKey(f, c.PrivateKeyPassphrase); err != nil {
+				customPrint(fmt.Sprintf("Skipping IdentityFile %s: %v", f, err), DEBUG, true)
+				continue
+			}
+			c.PrivateKeyPath = f
+			break
+		}
+	}
+	if v := get("UserKnownHostsFile"); v != "" && !strings.EqualFold(v, "none") {
+		for _, f := range strings.Fields(v) {
+			h.knownHosts = append(h.knownHosts, expandHome(tokens.Replace(f)))
+		}
+	}
+	if v := get("ProxyJump"); !strings.EqualFold(v, "none") {
+		h.proxyJump = v
+	}
+	if c.Host != cfg.Host || h.proxyJump != "" {
+		customPrint(fmt.Sprintf("ssh config: %s is %s@%s:%d", cfg.Host, c.Username, c.Host, c.Port), DEBUG, true)
+	}
+	return h
+}
+
+// sshConfigLookup returns functions reading the first value, and all
+// values, of a keyword for alias from ~/.ssh/config and then the system-wide
+// ssh config. Unset keywords read as ssh's defaults; a file that cannot be
+// parsed is reported and skipped.
+func sshConfigLookup(alias string) (func(string) string, func(string) []string) {
+	var files []*ssh_config.Config
+	for _, p := range []string{expandHome("~/.ssh/config"), sshSystemConfigPath()} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				customPrint(fmt.Sprintf("Ignoring ssh config %s: %v", p, err), WARN, false)
+			}
+			continue
+		}
+		c, err := ssh_config.DecodeBytes(data)
+		if err != nil {
+			customPrint(fmt.Sprintf("Ignoring ssh config %s: %v", p, err), WARN, false)
+			continue
+		}
+		files = append(files, c)
+	}
+	get := func(key string) string {
+		for _, c := range files {
+			if v, err := c.Get(alias, key); err == nil && v != "" {
+				return v
+			}
+		}
+		return ssh_config.Default(key)
+	}
+	getAll := func(key string) []string {
+		for _, c := range files {
+			if v, err := c.GetAll(alias, key); err == nil && len(v) > 0 {
+				return v
+			}
+		}
+		if d := ssh_config.Default(key); d != "" {
+			return []string{d}
+		}
+		return nil
+	}
+	return get, getAll
+}
+
+// sshSystemConfigPath returns where OpenSSH keeps its system-wide config.
+func sshSystemConfigPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "ssh", "ssh_config")
+	}
+	return "/etc/ssh/ssh_config"
+}
+
+// sshPort returns the Port the ssh config gives, or 22.
+func sshPort(get func(string) string) int {
+	if p := atoi(get("Port")); p > 0 {
+		return p
+	}
+	return 22
+}
+
+// defaultPort returns the port to use for host when the config sets none.
+func defaultPort(host string) int {
+	get, _ := sshConfigLookup(host)
+	return sshPort(get)
+}
+
+// sshTokens expands the % tokens ssh allows in IdentityFile and
+// UserKnownHostsFile.
+func sshTokens(cfg *Config, alias string) *strings.Replacer {
+	home, _ := os.UserHomeDir()
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", cfg.Host,
+		"%n", alias,
+		"%p", fmt.Sprint(cfg.Port),
+		"%r", cfg.Username,
+		"%u", localUsername(),
+	)
+}
+
+// localUsername returns the name of the user running gofilesync, which ssh
+// logs in as when no user is configured.
+func localUsername() string {
+	if u, err := user.Current(); err == nil {
+		// Windows names come as DOMAIN\user.
+		name := u.Username
+		if i := strings.LastIndex(name, `\`); i >= 0 {
+			name = name[i+1:]
+		}
+		return name
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return os.Getenv("USERNAME")
+}
+
+// --- Keyboard-Interactive ---
+
+// kbdCommandTimeout bounds how long Config.KeyboardInteractiveCommand may
+// take to produce an answer, e.g. while waiting for a push approval.
+const kbdCommandTimeout = 2 * time.Minute
+
+// configChallenge answers keyboard-interactive prompts without a user.
+// Password prompts get Config.Password; any other prompt, typically for a
+// one-time code, is answered by Config.KeyboardInteractiveCommand if set,
+// and otherwise with the current code for Config.TOTPSecret.
+func configChallenge(cfg *Config) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			customPrint(fmt.Sprintf("Keyboard-interactive prompt: %q", q), DEBUG, false)
+			var err error
+			switch {
+			case strings.Contains(strings.ToLower(q), "password") && cfg.Password != "":
+				answers[i] = cfg.Password
+			case cfg.KeyboardInteractiveCommand != "":
+				answers[i], err = runPromptCommand(cfg.KeyboardInteractiveCommand, q)
+			case cfg.TOTPSecret != "":
+				answers[i], err = totpCode(cfg.TOTPSecret, time.Now())
+			default:
+				err = fmt.Errorf("no answer configured for prompt %q: set totp_secret or keyboard_interactive_command", q)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return answers, nil
+	}
+}
+
+// runPromptCommand runs command through the shell with the prompt in
+// $GOFILESYNC_PROMPT and returns the first line it prints.
+func runPromptCommand(command, prompt string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kbdCommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "GOFILESYNC_PROMPT="+prompt)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keyboard_interactive_command failed: %w", err)
+	}
+	answer, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimRight(answer, "\r"), nil
+}
+
+// totpCode returns the RFC 6238 one-time code for the base32 secret at t,
+// with the parameters authenticator apps use: HMAC-SHA1, 30-second steps
+// and six digits.
+func totpCode(secret string, t time.Time) (string, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp_secret: %w", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// loadPrivateKey reads an RSA, ECDSA or Ed25519 private key in PEM or
+// OpenSSH format, decrypting it with passphrase if it is encrypted.
+func loadPrivateKey(p, passphrase string) (ssh.Signer, error) {
+	p = expandHome(p)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("private key %s is encrypted; set private_key_passphrase", p)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", p, err)
+	}
+	customPrint(fmt.Sprintf("Loaded %s key %s (%s)", signer.PublicKey().Type(), p, ssh.FingerprintSHA256(signer.PublicKey())), DEBUG, true)
+	return signer, nil
+}
+
+// expandHome replaces a leading ~ with the user's home directory.
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") && !strings.HasPrefix(p, `~\`) {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
+
+// --- Host Key Verification ---
+
+// unknownHostKeyError is returned when the server's key is in none of the
+// known_hosts files and no fingerprint is pinned.
+type unknownHostKeyError struct {
+	Host       string
+	Key        ssh.PublicKey
+	KnownHosts string // the app's known_hosts file, where the key can be added
+}
+
+func (e *unknownHostKeyError) Error() string {
+	return fmt.Sprintf("host key for %s is not known (%s %s); add it to %s, accept it in setup, or set host_key_fingerprint",
+		e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key), e.KnownHosts)
+}
+
+// appKnownHostsPath returns gofilesync's own known_hosts file, where keys
+// accepted in setup are stored: Config.KnownHostsFile if set, otherwise
+// known_hosts in the user config directory.
+func appKnownHostsPath(cfg *Config) string {
+	if cfg != nil && cfg.KnownHostsFile != "" {
+		return expandHome(cfg.KnownHostsFile)
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "gofilesync", "known_hosts")
+}
+
+// trustHostKey records key as the host key of host (as passed to the host
+// key callback) in the known_hosts file at path.
+func trustHostKey(path, host string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(host)}, key)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	customPrint(fmt.Sprintf("Added %s key %s for %s to %s", key.Type(), ssh.FingerprintSHA256(key), host, path), INFO, true)
+	return nil
+}
+
+// hostKeyVerifier checks server keys against the pinned
+// Config.HostKeyFingerprint if there is one, and otherwise against the
+// user's known_hosts files (userKnownHosts, by default ~/.ssh/known_hosts)
+// and the app's own known_hosts file. It also returns the
+// host key algorithms to ask addr for, with the known ones first, so that a
+// server holding several keys presents the one that is known rather than one
+// that looks like a change.
+func hostKeyVerifier(cfg *Config, addr string, userKnownHosts []string) (ssh.HostKeyCallback, []string, error) {
+	if cfg.HostKeyFingerprint != "" {
+		want := cfg.HostKeyFingerprint
+		if !strings.HasPrefix(want, "SHA256:") {
+			want = "SHA256:" + want
+		}
+		return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != want {
+				customPrint(fmt.Sprintf("HOST KEY MISMATCH for %s: expected %s, server presented %s %s. Refusing to connect; the server may be impersonated.", hostname, want, key.Type(), got), WARN, false)
+				return fmt.Errorf("host key for %s does not match host_key_fingerprint: got %s, want %s", hostname, got, want)
+			}
+			return nil
+		}, nil, nil
+	}
+
+	if userKnownHosts == nil {
+		userKnownHosts = []string{expandHome("~/.ssh/known_hosts")}
+	}
+	var files []string
+	for _, f := range append(userKnownHosts, appKnownHostsPath(cfg)) {
+		// knownhosts.New fails on files that do not exist.
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	check := func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+	if len(files) > 0 {
+		var err error
+		if check, err = knownhosts.New(files...); err != nil {
+			return nil, nil, fmt.Errorf("failed to read known_hosts: %w", err)
+		}
+	}
+	var algorithms []string
+	var probeErr *knownhosts.KeyError
+	if errors.As(check(addr, &net.TCPAddr{}, probeKey{}), &probeErr) {
+		for _, k := range probeErr.Want {
+			algorithms = append(algorithms, hostKeyAlgorithmsFor(k.Key.Type())...)
+		}
+		if len(algorithms) > 0 {
+			for _, a := range ssh.SupportedAlgorithms().HostKeys {
+				if !slices.Contains(algorithms, a) {
+					algorithms = append(algorithms, a)
+				}
+			}
+		}
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) == 0 {
+			return &unknownHostKeyError{Host: hostname, Key: key, KnownHosts: appKnownHostsPath(cfg)}
+		}
+		var known []string
+		for _, k := range keyErr.Want {
+			known = append(known, fmt.Sprintf("%s:%d", k.Filename, k.Line))
+		}
+		customPrint(fmt.Sprintf("HOST KEY CHANGED for %s: server presented %s %s, which does not match %s. Refusing to connect; the server may be impersonated. If the key change is expected, remove the old entry.", hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(known, ", ")), WARN, false)
+		return fmt.Errorf("host key for %s has changed (known in %s)", hostname, strings.Join(known, ", "))
+	}, algorithms, nil
+}
+
+// hostKeyAlgorithmsFor returns the signature algorithms usable with a host
+// key of the given type.
+func hostKeyAlgorithmsFor(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// probeKey matches no known_hosts entry, so checking it reports every key
+// known for a host.
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "gofilesync-probe" }
+func (probeKey) Marshal() []byte                     { return []byte("gofilesync-probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key cannot verify") }
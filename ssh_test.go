@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The RFC 6238 SHA-1 test vectors, cut to the six digits apps show. The
+// secret is the ASCII string "12345678901234567890" in base32.
+func TestTOTPCode(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		secret string
+		unix   int64
+		want   string
+	}{
+		{secret, 59, "287082"},
+		{secret, 1111111109, "081804"},
+		{secret, 1111111111, "050471"},
+		{secret, 1234567890, "005924"},
+		{secret, 2000000000, "279037"},
+		{"gezd gnbv gy3t qojq gezd gnbv gy3t qojq", 59, "287082"},
+		{secret + "====", 59, "287082"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(tt.secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Errorf("totpCode(%q, %d): %v", tt.secret, tt.unix, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("totpCode(%q, %d) = %s, want %s", tt.secret, tt.unix, got, tt.want)
+		}
+	}
+	if _, err := totpCode("not base32!", time.Unix(59, 0)); err == nil {
+		t.Error("totpCode accepted an invalid secret")
+	}
+}
@@ -0,0 +1,2025 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+// --- Sync Engine ---
+
+// defaultDebounce is the quiet period used when Config.DebounceMs is unset.
+const defaultDebounce = 500 * time.Millisecond
+
+// defaultPollInterval is how often the remote tree is listed in pull and
+// bidirectional mode when Config.PollIntervalSec is unset.
+const defaultPollInterval = 30 * time.Second
+
+// Sync directions accepted in Config.Mode.
+const (
+	modePush          = "push"
+	modePull          = "pull"
+	modeBidirectional = "bidirectional"
+)
+
+// Conflict policies accepted in Config.ConflictPolicy.
+const (
+	conflictNewest   = "newest"
+	conflictLocal    = "local"
+	conflictRemote   = "remote"
+	conflictKeepBoth = "keep-both"
+)
+
+// maxTransferAttempts bounds how often one upload or download is retried
+// over a new connection after the previous one dropped.
+const maxTransferAttempts = 5
+
+// defaultMaxTransfers is the size of the transfer worker pool when
+// MaxConcurrentTransfers is unset.
+const defaultMaxTransfers = 4
+
+// defaultKeepalive is how often the server is pinged when KeepaliveSec is unset.
+const defaultKeepalive = 15 * time.Second
+
+// minBackoff and defaultMaxBackoff bound the wait between reconnect attempts
+// while the server is unreachable; ReconnectMaxBackoffSec overrides the latter.
+const (
+	minBackoff        = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// resumeMinSize is the smallest file whose transfer is recorded for resuming.
+// Smaller ones are sent again from the start after an interruption, as
+// saving the state file before each of them would cost more than it saves.
+const resumeMinSize = 8 << 20
+
+// tempSuffix marks gofilesync's in-flight transfer files, which are named
+// ".<name>.gofilesync.tmp" next to their target and never synced themselves.
+const tempSuffix = ".gofilesync.tmp"
+
+type syncEngine struct {
+	cfg         *Config
+	connMu      sync.RWMutex // guards conn, client and clientDone
+	conn        *ssh.Client
+	client      *sftp.Client
+	clientDone  chan struct{} // closed once client's connection has gone away
+	reconnectMu sync.Mutex    // serialises reconnects from transfer workers
+	jumps       jumpChain     // jump host connections, kept across reconnects
+	statePath   string
+	state       *syncState
+}
+
+func newSyncEngine(cfg *Config, statePath string) *syncEngine {
+	return &syncEngine{cfg: cfg, statePath: statePath}
+}
+
+// runProfiles syncs all profiles at once, each with its own engine and
+// state file, until ctx is cancelled. A profile that fails is reported
+// without stopping the others.
+func runProfiles(ctx context.Context, configPath string, profiles []*Config) error {
+	if len(profiles) == 1 {
+		return newSyncEngine(profiles[0], stateFilePath(configPath, profiles[0].Name)).run(ctx)
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	for _, p := range profiles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := newSyncEngine(p, stateFilePath(configPath, p.Name)).run(ctx); err != nil {
+				customPrint(fmt.Sprintf("[%s] Sync failed: %v", p.Name, err), WARN, false)
+				mu.Lock()
+				failed = append(failed, p.Name)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d profiles failed: %s", len(failed), len(profiles), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// log is customPrint with the profile name in front, so that the output of
+// profiles running side by side can be told apart.
+func (e *syncEngine) log(message string, level LogLevel, skipConsole bool) {
+	if e.cfg.Name != "" {
+		message = "[" + e.cfg.Name + "] " + message
+	}
+	customPrint(message, level, skipConsole)
+}
+
+// run connects to the SFTP server, brings both sides in line according to
+// Config.Mode and then keeps them there, from fsnotify events for local
+// changes and by polling for remote ones, until ctx is cancelled.
+func (e *syncEngine) run(ctx context.Context) error {
+	mode, err := e.mode()
+	if err != nil {
+		return err
+	}
+	if _, err := e.conflictPolicy(); err != nil {
+		return err
+	}
+	info, err := os.Stat(e.cfg.LocalPath)
+	if err != nil {
+		return fmt.Errorf("cannot access local path: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("local path %s is not a directory", e.cfg.LocalPath)
+	}
+
+	arrow := map[string]string{modePush: "->", modePull: "<-", modeBidirectional: "<->"}[mode]
+	target := e.cfg.Host
+	if e.cfg.Username != "" {
+		target = e.cfg.Username + "@" + target
+	}
+	e.log(fmt.Sprintf("Starting %s sync: %s %s %s:%s", mode, e.cfg.LocalPath, arrow, target, e.cfg.RemotePath), INFO, false)
+
+	state, err := loadSyncState(e.statePath)
+	if err != nil {
+		return fmt.Errorf("failed to load sync state: %w", err)
+	}
+	e.state = state
+	defer e.saveState()
+
+	defer e.jumps.close()
+	if err := e.connect(); err != nil {
+		return err
+	}
+	defer e.disconnect()
+	client := e.remote()
+
+	if mode == modePull {
+		// A mirror only reads from the server; a missing source is an error.
+		if _, err := client.Stat(e.cfg.RemotePath); err != nil {
+			return fmt.Errorf("cannot access remote path %s: %w", e.cfg.RemotePath, err)
+		}
+	} else {
+		if err := client.MkdirAll(e.cfg.RemotePath); err != nil {
+			return fmt.Errorf("failed to create remote path %s: %w", e.cfg.RemotePath, err)
+		}
+		e.cleanupRemoteTemps()
+	}
+	e.cleanupLocalTemps()
+
+	var watcher *fsnotify.Watcher
+	if mode != modePull {
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("failed to create file watcher: %w", err)
+		}
+		defer watcher.Close()
+		// Watch before the initial walk so nothing changed during it is missed.
+		if err := e.watchTree(watcher, e.cfg.LocalPath); err != nil {
+			return err
+		}
+	}
+
+	err = e.fullSync(ctx)
+	e.saveState()
+	resync := false
+	if err != nil {
+		if ctx.Err() != nil {
+			e.log("Sync stopped.", INFO, false)
+			return nil
+		}
+		if !e.offline() {
+			// Failed files have been logged; the watch loop retries each
+			// one when it changes again.
+			e.log(fmt.Sprintf("Initial sync incomplete: %v", err), WARN, false)
+		} else {
+			// The watch loop reconnects and runs the whole pass again.
+			e.log(fmt.Sprintf("Initial sync interrupted: %v", err), WARN, false)
+			resync = true
+		}
+	}
+
+	if watcher != nil {
+		e.log(fmt.Sprintf("Watching %s for changes", e.cfg.LocalPath), INFO, false)
+	}
+	return e.watchLoop(ctx, watcher, resync)
+}
+
+// fullSync compares both trees in full, as done at startup.
+func (e *syncEngine) fullSync(ctx context.Context) error {
+	mode, _ := e.mode()
+	// Remote changes go first so that files changed on both sides are
+	// caught as conflicts before the local pass would overwrite them.
+	if mode != modePush {
+		if err := e.pullTree(ctx); err != nil {
+			return err
+		}
+	}
+	if mode != modePull {
+		return e.syncTree(ctx, ".")
+	}
+	return nil
+}
+
+// mode returns the configured sync direction, defaulting to push.
+func (e *syncEngine) mode() (string, error) {
+	switch m := strings.ToLower(e.cfg.Mode); m {
+	case "":
+		return modePush, nil
+	case modePush, modePull, modeBidirectional:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown sync mode %q (expected %s, %s or %s)", e.cfg.Mode, modePush, modePull, modeBidirectional)
+	}
+}
+
+// conflictPolicy returns how files changed on both sides are resolved,
+// defaulting to the newest copy winning.
+func (e *syncEngine) conflictPolicy() (string, error) {
+	switch p := strings.ToLower(e.cfg.ConflictPolicy); p {
+	case "":
+		return conflictNewest, nil
+	case conflictNewest, conflictLocal, conflictRemote, conflictKeepBoth:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q (expected %s, %s, %s or %s)", e.cfg.ConflictPolicy, conflictNewest, conflictLocal, conflictRemote, conflictKeepBoth)
+	}
+}
+
+// pollInterval returns how often the remote tree is listed for changes.
+func (e *syncEngine) pollInterval() time.Duration {
+	if e.cfg.PollIntervalSec > 0 {
+		return time.Duration(e.cfg.PollIntervalSec) * time.Second
+	}
+	return defaultPollInterval
+}
+
+// debounce returns how long a path must stay quiet before it is synced.
+func (e *syncEngine) debounce() time.Duration {
+	if e.cfg.DebounceMs > 0 {
+		return time.Duration(e.cfg.DebounceMs) * time.Millisecond
+	}
+	return defaultDebounce
+}
+
+// maxTransfers returns how many files may be transferred at once. The
+// transfers share one connection, as SFTP requests can be in flight
+// concurrently.
+func (e *syncEngine) maxTransfers() int {
+	if e.cfg.MaxConcurrentTransfers > 0 {
+		return e.cfg.MaxConcurrentTransfers
+	}
+	return defaultMaxTransfers
+}
+
+// keepaliveInterval returns how often the server is pinged over SSH.
+func (e *syncEngine) keepaliveInterval() time.Duration {
+	if e.cfg.KeepaliveSec > 0 {
+		return time.Duration(e.cfg.KeepaliveSec) * time.Second
+	}
+	return defaultKeepalive
+}
+
+// backoff returns the wait before reconnect attempt n (counting from 0). It
+// doubles from minBackoff up to ReconnectMaxBackoffSec, and the upper half is
+// randomised so that clients dropped together do not retry in lockstep.
+func (e *syncEngine) backoff(n int) time.Duration {
+	limit := defaultMaxBackoff
+	if e.cfg.ReconnectMaxBackoffSec > 0 {
+		limit = time.Duration(e.cfg.ReconnectMaxBackoffSec) * time.Second
+	}
+	d := limit
+	if n < 20 {
+		d = min(minBackoff<<n, limit)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// connect opens the SSH and SFTP connection, keeps it alive and notes when
+// it goes away.
+func (e *syncEngine) connect() error {
+	conn, err := e.jumps.dial(e.cfg, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s:%d: %w", e.cfg.Host, e.cfg.Port, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SFTP session on %s:%d: %w", e.cfg.Host, e.cfg.Port, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		// The SFTP session can end on its own; take the SSH connection
+		// down with it so nothing keeps using half a connection.
+		conn.Close()
+		close(done)
+	}()
+	go e.keepAlive(conn, done)
+	e.connMu.Lock()
+	e.conn, e.client, e.clientDone = conn, client, done
+	e.connMu.Unlock()
+	e.log(fmt.Sprintf("Connected to %s:%d", e.cfg.Host, e.cfg.Port), DEBUG, false)
+	return nil
+}
+
+// keepAlive sends an OpenSSH keepalive request every keepaliveInterval and
+// closes conn when one goes unanswered, so that a silently dropped connection
+// (a NAT timeout, a suspended laptop) is noticed rather than hanging the next
+// transfer. Any reply counts, including a refusal of the request.
+func (e *syncEngine) keepAlive(conn *ssh.Client, done <-chan struct{}) {
+	interval := e.keepaliveInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			e.log(fmt.Sprintf("Keepalive to %s:%d failed: %v", e.cfg.Host, e.cfg.Port, err), WARN, false)
+		case <-time.After(interval):
+			e.log(fmt.Sprintf("No keepalive reply from %s:%d within %s", e.cfg.Host, e.cfg.Port, interval), WARN, false)
+		}
+		conn.Close()
+		return
+	}
+}
+
+// remote returns the current SFTP client. A transfer worker may replace it
+// through reconnect at any time, so it is fetched for every operation.
+func (e *syncEngine) remote() *sftp.Client {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+	return e.client
+}
+
+// done returns the channel that is closed when the current connection goes.
+func (e *syncEngine) done() <-chan struct{} {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+	return e.clientDone
+}
+
+// disconnect closes the current connection, if any.
+func (e *syncEngine) disconnect() {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+	if e.client != nil {
+		e.client.Close()
+	}
+	if e.conn != nil {
+		e.conn.Close()
+	}
+}
+
+// reconnect replaces the dropped connection identified by stale with a fresh
+// one. If another worker has already done so, it returns straight away. It
+// makes a single attempt; waiting out a longer outage is up to watchLoop.
+func (e *syncEngine) reconnect(stale <-chan struct{}) error {
+	e.reconnectMu.Lock()
+	defer e.reconnectMu.Unlock()
+	if e.done() != stale && !e.offline() {
+		return nil
+	}
+	e.disconnect()
+	e.log(fmt.Sprintf("Reconnecting to %s:%d", e.cfg.Host, e.cfg.Port), DEBUG, false)
+	return e.connect()
+}
+
+// offline reports whether the current connection has gone away.
+func (e *syncEngine) offline() bool {
+	select {
+	case <-e.done():
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionLost reports whether err came from the connection dropping
+// rather than from the operation itself.
+func (e *syncEngine) connectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || e.offline()
+}
+
+// skipFailed logs err as the failure to sync rel and returns nil, so that a
+// pass goes on with the next file. Errors from the connection dropping or
+// ctx ending are returned instead, as they stop every other file too.
+func (e *syncEngine) skipFailed(ctx context.Context, rel string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if e.connectionLost(err) {
+		return err
+	}
+	e.log(fmt.Sprintf("Failed to sync %s: %v", rel, err), WARN, false)
+	return nil
+}
+
+// transfer runs fn, reconnecting and running it again for as long as it fails
+// because the connection dropped. fn is expected to resume from whatever the
+// previous attempt left behind.
+func (e *syncEngine) transfer(what string, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= maxTransferAttempts; attempt++ {
+		stale := e.done()
+		err = fn()
+		if err == nil || !e.connectionLost(err) {
+			return err
+		}
+		e.log(fmt.Sprintf("Connection lost during %s (attempt %d of %d): %v", what, attempt, maxTransferAttempts, err), WARN, false)
+		if attempt == maxTransferAttempts {
+			break
+		}
+		if rerr := e.reconnect(stale); rerr != nil {
+			// Leave it to watchLoop to wait for the server to come back.
+			e.log(fmt.Sprintf("Reconnect failed: %v", rerr), WARN, false)
+			break
+		}
+	}
+	return err
+}
+
+// watchLoop collects fsnotify events and syncs each touched path once it has
+// been quiet for the debounce period, so a burst of writes from an editor or
+// build tool turns into a single upload. Outside push mode it also polls the
+// remote tree. watcher is nil in pull mode.
+//
+// When the connection drops, changes keep being queued while the loop
+// reconnects with backoff; once it is back the queue is flushed, preceded
+// by a full pass when resync is set because the startup pass was cut short.
+func (e *syncEngine) watchLoop(ctx context.Context, watcher *fsnotify.Watcher, resync bool) error {
+	debounce := e.debounce()
+	pending := make(map[string]time.Time) // rel path -> deadline
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	armed := false
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if watcher != nil {
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+	var poll <-chan time.Time
+	if mode, _ := e.mode(); mode != modePush {
+		ticker := time.NewTicker(e.pollInterval())
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	lost := e.done()
+	var retry <-chan time.Time
+	attempt := 0
+	if resync {
+		// Already offline; run the reconnect logic straight away.
+		lost, retry = nil, time.After(e.backoff(0))
+		attempt = 1
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.log("Sync stopped.", INFO, false)
+			return nil
+		case <-lost:
+			if !e.offline() {
+				// A transfer already reconnected.
+				lost = e.done()
+				continue
+			}
+			lost = nil
+			e.log(fmt.Sprintf("Connection to %s:%d lost; queueing changes until it is back", e.cfg.Host, e.cfg.Port), WARN, false)
+			retry = time.After(e.backoff(0))
+			attempt = 1
+		case <-retry:
+			retry = nil
+			if err := e.reconnect(e.done()); err != nil {
+				wait := e.backoff(attempt)
+				attempt++
+				e.log(fmt.Sprintf("Reconnect failed, retrying in %s: %v", wait.Round(time.Second), err), WARN, false)
+				retry = time.After(wait)
+				continue
+			}
+			lost = e.done()
+			e.log(fmt.Sprintf("Reconnected to %s:%d; flushing %d queued changes", e.cfg.Host, e.cfg.Port, len(pending)), INFO, false)
+			if resync {
+				if err := e.fullSync(ctx); err != nil && ctx.Err() == nil {
+					e.log(fmt.Sprintf("Sync after reconnect failed: %v", err), WARN, false)
+					resync = e.offline()
+				} else {
+					resync = false
+				}
+				e.saveState()
+			}
+			now := time.Now()
+			for rel := range pending {
+				pending[rel] = now
+			}
+			if len(pending) > 0 {
+				timer.Reset(0)
+				armed = true
+			}
+		case <-poll:
+			if e.offline() {
+				continue
+			}
+			if err := e.pullTree(ctx); err != nil && ctx.Err() == nil {
+				e.log(fmt.Sprintf("Failed to check remote for changes: %v", err), WARN, false)
+			}
+			e.saveState()
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("file watcher closed unexpectedly")
+			}
+			rel, ok := e.handleEvent(watcher, ev)
+			if !ok {
+				continue
+			}
+			pending[rel] = time.Now().Add(debounce)
+			// Later events always have later deadlines, so an armed timer
+			// already fires for the earliest pending path.
+			if !armed {
+				timer.Reset(debounce)
+				armed = true
+			}
+		case err, ok := <-watchErrors:
+			if !ok {
+				return fmt.Errorf("file watcher closed unexpectedly")
+			}
+			e.log(fmt.Sprintf("File watcher error: %v", err), WARN, false)
+		case <-timer.C:
+			armed = false
+			if e.offline() {
+				// Keep everything queued; reconnecting flushes it.
+				continue
+			}
+			now := time.Now()
+			var due []string
+			var next time.Time
+			for rel, deadline := range pending {
+				if deadline.After(now) {
+					if next.IsZero() || deadline.Before(next) {
+						next = deadline
+					}
+					continue
+				}
+				due = append(due, rel)
+				delete(pending, rel)
+			}
+			e.flush(ctx, due, pending)
+			e.saveState()
+			if !next.IsZero() {
+				timer.Reset(time.Until(next))
+				armed = true
+			}
+		}
+	}
+}
+
+// handleEvent keeps the watch list current and returns the relative path that
+// needs syncing for ev, if any.
+func (e *syncEngine) handleEvent(watcher *fsnotify.Watcher, ev fsnotify.Event) (string, bool) {
+	e.log(fmt.Sprintf("Watcher event: %s", ev), TRACE, true)
+	rel, err := filepath.Rel(e.cfg.LocalPath, ev.Name)
+	if err != nil || rel == "." || e.isInternal(ev.Name) {
+		return "", false
+	}
+	if ev.Has(fsnotify.Create) {
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			if err := e.watchTree(watcher, ev.Name); err != nil {
+				e.log(fmt.Sprintf("Failed to watch new directory %s: %v", rel, err), WARN, false)
+			}
+		}
+	}
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		// Watches on subdirectories of a moved directory keep their old
+		// names; drop them; the new location is watched on its Create.
+		prefix := ev.Name + string(filepath.Separator)
+		for _, w := range watcher.WatchList() {
+			if w == ev.Name || strings.HasPrefix(w, prefix) {
+				_ = watcher.Remove(w)
+			}
+		}
+	}
+	return rel, true
+}
+
+// watchTree adds dir and every directory below it to the watcher. fsnotify
+// is not recursive, so each directory needs its own watch.
+func (e *syncEngine) watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			e.log(fmt.Sprintf("Cannot watch %s: %v", p, err), WARN, false)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(p); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", p, err)
+		}
+		return nil
+	})
+}
+
+// flush syncs the paths whose debounce period has expired. Paths that no
+// longer exist locally are handled first, so that a rename can be matched to
+// its new name before that name is uploaded as a new file.
+func (e *syncEngine) flush(ctx context.Context, due []string, pending map[string]time.Time) {
+	var gone, present []string
+	for _, rel := range due {
+		if _, err := os.Lstat(filepath.Join(e.cfg.LocalPath, rel)); err != nil {
+			gone = append(gone, rel)
+		} else {
+			present = append(present, rel)
+		}
+	}
+	for _, rel := range gone {
+		if e.offline() {
+			pending[rel] = time.Now()
+			continue
+		}
+		candidates := append([]string(nil), present...)
+		for p := range pending {
+			candidates = append(candidates, p)
+		}
+		renamedTo, err := e.syncRemoval(rel, candidates)
+		if err != nil {
+			e.log(fmt.Sprintf("Failed to propagate removal of %s: %v", rel, err), WARN, false)
+			if e.offline() {
+				pending[rel] = time.Now()
+			}
+			continue
+		}
+		if renamedTo != "" {
+			delete(pending, renamedTo)
+			present = slices.DeleteFunc(present, func(p string) bool { return p == renamedTo })
+		}
+	}
+	for _, rel := range present {
+		// Paths that fail because the connection went are retried once it is back.
+		if e.offline() {
+			pending[rel] = time.Now()
+			continue
+		}
+		if err := e.syncPath(ctx, rel); err != nil && e.offline() {
+			pending[rel] = time.Now()
+		}
+	}
+}
+
+// syncPath syncs a single path reported by the watcher. Failures are logged
+// as well as returned, and never stop the watcher.
+func (e *syncEngine) syncPath(ctx context.Context, rel string) error {
+	info, err := os.Lstat(filepath.Join(e.cfg.LocalPath, rel))
+	if err != nil {
+		// Already gone again; nothing to upload.
+		return nil
+	}
+	if info.IsDir() {
+		err = e.syncTree(ctx, rel)
+	} else if info.Mode().IsRegular() {
+		if err = e.remote().MkdirAll(path.Dir(e.remotePathFor(rel))); err == nil {
+			_, err = e.syncFile(rel, info)
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		e.log(fmt.Sprintf("Failed to sync %s: %v", rel, err), WARN, false)
+	}
+	return err
+}
+
+// syncRemoval propagates the disappearance of rel to the remote side. If one
+// of candidates holds the same content as rel did, the remote path is renamed
+// rather than deleted and re-uploaded, and the candidate is returned.
+func (e *syncEngine) syncRemoval(rel string, candidates []string) (string, error) {
+	entries := e.state.tree(rel)
+	// A rename removes the old remote name, so it is off when deletes are.
+	if !e.cfg.NoRemoteDelete && len(entries) > 0 {
+		for _, c := range candidates {
+			if !e.matchesRename(rel, entries, c) {
+				continue
+			}
+			if err := e.renameRemote(rel, c); err != nil {
+				e.log(fmt.Sprintf("Failed to rename %s to %s remotely, uploading instead: %v", rel, c, err), WARN, false)
+				break
+			}
+			return c, nil
+		}
+	}
+	return "", e.deleteRemote(rel)
+}
+
+// matchesRename reports whether the untracked path cand looks like rel after
+// a move: the same content for a file, or the same files and sizes for a
+// directory. entries are the state entries of rel.
+func (e *syncEngine) matchesRename(rel string, entries map[string]fileState, cand string) bool {
+	if len(e.state.tree(cand)) > 0 {
+		return false
+	}
+	candPath := filepath.Join(e.cfg.LocalPath, cand)
+	info, err := os.Lstat(candPath)
+	if err != nil {
+		return false
+	}
+	if st, ok := entries[filepath.ToSlash(rel)]; ok {
+		if !info.Mode().IsRegular() || info.Size() != st.Size {
+			return false
+		}
+		hash, err := hashFile(candPath)
+		return err == nil && hash == st.Hash
+	}
+	if !info.IsDir() {
+		return false
+	}
+	prefix := filepath.ToSlash(rel) + "/"
+	for key, st := range entries {
+		fi, err := os.Lstat(filepath.Join(candPath, filepath.FromSlash(strings.TrimPrefix(key, prefix))))
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() != st.Size {
+			return false
+		}
+	}
+	return true
+}
+
+// renameRemote moves oldRel to newRel on the server.
+func (e *syncEngine) renameRemote(oldRel, newRel string) error {
+	oldRemote, newRemote := e.remotePathFor(oldRel), e.remotePathFor(newRel)
+	if err := e.remote().MkdirAll(path.Dir(newRemote)); err != nil {
+		return err
+	}
+	if err := e.rename(oldRemote, newRemote, false); err != nil {
+		return err
+	}
+	e.state.rename(oldRel, newRel)
+	e.log(fmt.Sprintf("Renamed %s -> %s", oldRel, newRel), INFO, false)
+	e.pruneRemoteDirs(filepath.Dir(oldRel))
+	return nil
+}
+
+// deleteRemote removes rel (a file or a whole directory) from the server,
+// unless NoRemoteDelete is set, and forgets it in the state store.
+func (e *syncEngine) deleteRemote(rel string) error {
+	defer e.state.removeTree(rel)
+	if e.cfg.NoRemoteDelete {
+		e.log(fmt.Sprintf("Keeping remote copy of removed %s (no_remote_delete)", rel), DEBUG, false)
+		return nil
+	}
+	if mode, _ := e.mode(); mode == modeBidirectional {
+		// Deleting here must not throw away an edit made on the server in
+		// the meantime. Forgetting the state lets the next poll bring it back.
+		for key, prev := range e.state.tree(rel) {
+			rinfo, err := e.remote().Stat(e.remotePathFor(filepath.FromSlash(key)))
+			if err == nil && remoteChanged(prev, rinfo) {
+				e.log(fmt.Sprintf("%s was deleted locally but changed remotely; keeping the remote copy", key), WARN, false)
+				return nil
+			}
+		}
+	}
+	remote := e.remotePathFor(rel)
+	if _, err := e.remote().Stat(remote); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := e.remote().RemoveAll(remote); err != nil {
+		return err
+	}
+	e.log(fmt.Sprintf("Deleted %s from remote", rel), INFO, false)
+	e.pruneRemoteDirs(filepath.Dir(rel))
+	return nil
+}
+
+// pruneRemoteDirs removes the remote counterparts of dir and its parents
+// for as long as they no longer exist locally and are empty remotely.
+func (e *syncEngine) pruneRemoteDirs(dir string) {
+	for dir != "." && dir != string(filepath.Separator) {
+		if _, err := os.Lstat(filepath.Join(e.cfg.LocalPath, dir)); err == nil {
+			return
+		}
+		if err := e.remote().RemoveDirectory(e.remotePathFor(dir)); err != nil {
+			return
+		}
+		e.log(fmt.Sprintf("Deleted empty directory %s from remote", dir), DEBUG, false)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// syncTree walks the local tree below rel ("." for everything), uploads
+// every file that changed since the last sync and propagates files that
+// disappeared in the meantime, renaming them remotely when an untracked file
+// has the same content.
+func (e *syncEngine) syncTree(ctx context.Context, rel string) error {
+	root := filepath.Join(e.cfg.LocalPath, rel)
+	e.log(fmt.Sprintf("Scanning %s", root), DEBUG, false)
+
+	type localFile struct {
+		rel  string
+		info fs.FileInfo
+	}
+	var files []localFile
+	seen := make(map[string]bool)
+	var unreadable []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			e.log(fmt.Sprintf("Skipping %s: %v", p, err), WARN, false)
+			if r, relErr := filepath.Rel(e.cfg.LocalPath, p); relErr == nil {
+				unreadable = append(unreadable, r)
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(e.cfg.LocalPath, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if err := e.remote().MkdirAll(e.remotePathFor(rel)); err != nil {
+				if err := e.skipFailed(ctx, rel, fmt.Errorf("failed to create remote directory: %w", err)); err != nil {
+					return err
+				}
+				// Nothing below it can be uploaded, nor deleted remotely.
+				unreadable = append(unreadable, rel)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			e.log(fmt.Sprintf("Skipping non-regular file %s", rel), DEBUG, false)
+			return nil
+		}
+		if e.isInternal(p) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			e.log(fmt.Sprintf("Skipping %s: %v", rel, err), WARN, false)
+			return nil
+		}
+		files = append(files, localFile{rel: rel, info: info})
+		seen[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Anything recorded under rel that the walk did not find is gone, unless
+	// it sits below a directory that could not be read.
+	vanished := make(map[string]fileState)
+	for key, st := range e.state.tree(rel) {
+		if seen[key] || underAny(key, unreadable) {
+			continue
+		}
+		vanished[key] = st
+	}
+
+	// Renames are matched here, one file at a time, as each one changes
+	// vanished; the uploads themselves are spread over the transfer workers.
+	var uploaded, unchanged atomic.Int64
+	renamed, deleted := 0, 0
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(e.maxTransfers())
+	for _, f := range files {
+		if gctx.Err() != nil {
+			break
+		}
+		if from := e.findRenameSource(f.rel, f.info, vanished); from != "" {
+			err := e.renameRemote(from, f.rel)
+			if err == nil {
+				delete(vanished, filepath.ToSlash(from))
+				renamed++
+				continue
+			}
+			e.log(fmt.Sprintf("Failed to rename %s to %s remotely, uploading instead: %v", from, f.rel, err), WARN, false)
+		}
+		g.Go(func() error {
+			changed, err := e.syncFile(f.rel, f.info)
+			if err != nil {
+				return e.skipFailed(gctx, f.rel, err)
+			}
+			if changed {
+				uploaded.Add(1)
+			} else {
+				unchanged.Add(1)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for key := range vanished {
+		if err := e.deleteRemote(filepath.FromSlash(key)); err != nil {
+			if err := e.skipFailed(ctx, key, fmt.Errorf("failed to delete remotely: %w", err)); err != nil {
+				return err
+			}
+			continue
+		}
+		deleted++
+	}
+	e.log(fmt.Sprintf("Sync pass complete: %d uploaded, %d renamed, %d deleted, %d unchanged", uploaded.Load(), renamed, deleted, unchanged.Load()), DEBUG, false)
+	return nil
+}
+
+// findRenameSource returns the vanished path whose recorded content matches
+// the untracked file rel, or "" if there is none.
+func (e *syncEngine) findRenameSource(rel string, info fs.FileInfo, vanished map[string]fileState) string {
+	if e.cfg.NoRemoteDelete || len(vanished) == 0 {
+		return ""
+	}
+	if _, known := e.state.get(rel); known {
+		return ""
+	}
+	var hash string
+	for key, st := range vanished {
+		if st.Size != info.Size() {
+			continue
+		}
+		if hash == "" {
+			h, err := hashFile(filepath.Join(e.cfg.LocalPath, rel))
+			if err != nil {
+				return ""
+			}
+			hash = h
+		}
+		if st.Hash == hash {
+			return filepath.FromSlash(key)
+		}
+	}
+	return ""
+}
+
+// underAny reports whether the slash-separated key lies at or below one of
+// the OS-specific relative paths in dirs.
+func underAny(key string, dirs []string) bool {
+	for _, d := range dirs {
+		d = filepath.ToSlash(d)
+		if d == "." || key == d || strings.HasPrefix(key, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// syncFile uploads rel if it changed since the upload recorded in the state
+// store. Files the store does not know yet are compared against the remote
+// copy instead, so a tree that is already in sync is not sent again. In
+// bidirectional mode a file that also changed remotely is handed to the
+// conflict policy. It reports whether an upload happened.
+func (e *syncEngine) syncFile(rel string, info fs.FileInfo) (bool, error) {
+	localFile := filepath.Join(e.cfg.LocalPath, rel)
+	remoteFile := e.remotePathFor(rel)
+	prev, known := e.state.get(rel)
+	if known && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		return false, nil
+	}
+	hash, err := hashFile(localFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash %s: %w", rel, err)
+	}
+	if known && prev.Size == info.Size() && prev.Hash == hash {
+		// Only the mtime moved (touch, checkout); the remote content is current.
+		prev.ModTime = info.ModTime()
+		e.state.put(rel, prev)
+		return false, nil
+	}
+	if !known {
+		rinfo, err := e.remote().Stat(remoteFile)
+		if err == nil && rinfo.Size() == info.Size() && rinfo.ModTime().Equal(info.ModTime().Truncate(time.Second)) {
+			e.state.put(rel, fileState{Size: info.Size(), ModTime: info.ModTime(), Hash: hash, RemoteModTime: rinfo.ModTime()})
+			return false, nil
+		}
+	}
+	if mode, _ := e.mode(); mode == modeBidirectional && known {
+		if rinfo, err := e.remote().Stat(remoteFile); err == nil && remoteChanged(prev, rinfo) {
+			return true, e.resolveConflict(rel, info, rinfo)
+		}
+	}
+	return true, e.upload(rel, info, hash)
+}
+
+// upload sends rel to the server and records it in the state store.
+func (e *syncEngine) upload(rel string, info fs.FileInfo, hash string) error {
+	remoteFile := e.remotePathFor(rel)
+	if err := e.uploadFile(rel, info); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", rel, err)
+	}
+	rinfo, err := e.remote().Stat(remoteFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat uploaded %s: %w", rel, err)
+	}
+	e.state.put(rel, fileState{Size: info.Size(), ModTime: info.ModTime(), Hash: hash, RemoteModTime: rinfo.ModTime()})
+	e.log(fmt.Sprintf("Uploaded %s (%d bytes)", rel, info.Size()), INFO, false)
+	return nil
+}
+
+// uploadFile sends rel to the server, retrying over a new connection if the
+// old one drops; each retry resumes from what already reached the server.
+func (e *syncEngine) uploadFile(rel string, info fs.FileInfo) error {
+	return e.transfer("upload of "+rel, func() error { return e.uploadOnce(rel, info) })
+}
+
+// uploadOnce writes rel to a hidden temp file next to its remote path and
+// renames it into place once complete, so nothing on the server ever sees a
+// partially written file at the final path. An interrupted upload leaves the
+// temp file behind so that the next attempt can resume it.
+func (e *syncEngine) uploadOnce(rel string, info fs.FileInfo) error {
+	src, err := os.Open(filepath.Join(e.cfg.LocalPath, rel))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	remoteFile := e.remotePathFor(rel)
+	tmp := remoteTempPath(remoteFile)
+	var dst *sftp.File
+	offset := e.uploadResumeOffset(rel, tmp, src, info)
+	if offset > 0 {
+		dst, err = e.remote().OpenFile(tmp, os.O_WRONLY)
+		if err == nil {
+			_, err = dst.Seek(offset, io.SeekStart)
+		}
+		if err == nil {
+			_, err = src.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			if dst != nil {
+				dst.Close()
+			}
+			return err
+		}
+		e.log(fmt.Sprintf("Resuming upload of %s at %d of %d bytes", rel, offset, info.Size()), INFO, false)
+	} else {
+		dst, err = e.remote().Create(tmp)
+		if err != nil {
+			return err
+		}
+		if info.Size() >= resumeMinSize {
+			e.state.putPartial(rel, partialTransfer{Size: info.Size(), ModTime: info.ModTime()})
+			e.saveState()
+		}
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	// From here on a failure means the temp file is not worth resuming.
+	fail := func(err error) error {
+		e.remote().Remove(tmp)
+		e.state.removePartial(rel)
+		return err
+	}
+	if e.canFsync() {
+		if err := dst.Sync(); err != nil {
+			dst.Close()
+			return fail(fmt.Errorf("fsync failed: %w", err))
+		}
+	}
+	if err := dst.Close(); err != nil {
+		return fail(err)
+	}
+	// Carry the local mtime over so later passes can tell the file is unchanged.
+	if err := e.remote().Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		return fail(err)
+	}
+	if err := e.rename(tmp, remoteFile, true); err != nil {
+		return fail(err)
+	}
+	e.state.removePartial(rel)
+	return nil
+}
+
+// uploadResumeOffset returns where an interrupted upload of rel can carry
+// on, or 0 to start over. The temp file must belong to an upload of the
+// same local file version and match the local file up to its size.
+func (e *syncEngine) uploadResumeOffset(rel, tmp string, src *os.File, info fs.FileInfo) int64 {
+	partial, ok := e.state.getPartial(rel)
+	if !ok || partial.Download || partial.Size != info.Size() || !partial.ModTime.Equal(info.ModTime()) {
+		return 0
+	}
+	tinfo, err := e.remote().Stat(tmp)
+	if err != nil || tinfo.Size() == 0 || tinfo.Size() > info.Size() {
+		return 0
+	}
+	remote, err := e.remote().Open(tmp)
+	if err != nil {
+		return 0
+	}
+	defer remote.Close()
+	if !e.samePrefix(src, remote, tinfo.Size()) {
+		e.log(fmt.Sprintf("Partial upload of %s does not match the local file, starting over", rel), WARN, false)
+		return 0
+	}
+	return tinfo.Size()
+}
+
+// cleanupLocalTemps is cleanupRemoteTemps for downloads into LocalPath.
+func (e *syncEngine) cleanupLocalTemps() {
+	filepath.WalkDir(e.cfg.LocalPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isTempName(d.Name()) {
+			return nil
+		}
+		if rel, err := filepath.Rel(e.cfg.LocalPath, filepath.FromSlash(tempTarget(filepath.ToSlash(p)))); err == nil {
+			if partial, ok := e.state.getPartial(rel); ok && partial.Download {
+				e.log(fmt.Sprintf("Keeping partial download %s for resuming", p), DEBUG, false)
+				return nil
+			}
+		}
+		if err := os.Remove(p); err != nil {
+			e.log(fmt.Sprintf("Failed to remove stale temp file %s: %v", p, err), WARN, false)
+			return nil
+		}
+		e.log(fmt.Sprintf("Removed stale temp file %s", p), INFO, false)
+		return nil
+	})
+}
+
+// rename moves oldpath to newpath on the server. With the OpenSSH
+// posix-rename extension an existing newpath is replaced atomically;
+// otherwise, if replace is set, newpath is removed first, which leaves a
+// short window where neither exists.
+func (e *syncEngine) rename(oldpath, newpath string, replace bool) error {
+	if _, ok := e.remote().HasExtension("posix-rename@openssh.com"); ok {
+		return e.remote().PosixRename(oldpath, newpath)
+	}
+	if replace {
+		if err := e.remote().Remove(newpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return e.remote().Rename(oldpath, newpath)
+}
+
+// canFsync reports whether the server supports the fsync@openssh.com
+// extension that File.Sync relies on.
+func (e *syncEngine) canFsync() bool {
+	data, ok := e.remote().HasExtension("fsync@openssh.com")
+	return ok && data == "1"
+}
+
+// cleanupRemoteTemps removes temp files left on the server by transfers that
+// were interrupted, e.g. by a crash, except those that can still be resumed.
+func (e *syncEngine) cleanupRemoteTemps() {
+	walker := e.remote().Walk(e.cfg.RemotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			e.log(fmt.Sprintf("Skipping remote %s: %v", walker.Path(), err), WARN, false)
+			continue
+		}
+		info := walker.Stat()
+		if info.IsDir() || !isTempName(info.Name()) {
+			continue
+		}
+		if rel, ok := e.remoteRel(tempTarget(walker.Path())); ok {
+			if partial, ok := e.state.getPartial(rel); ok && !partial.Download {
+				e.log(fmt.Sprintf("Keeping partial upload %s for resuming", walker.Path()), DEBUG, false)
+				continue
+			}
+		}
+		if err := e.remote().Remove(walker.Path()); err != nil {
+			e.log(fmt.Sprintf("Failed to remove stale temp file %s: %v", walker.Path(), err), WARN, false)
+			continue
+		}
+		e.log(fmt.Sprintf("Removed stale temp file %s", walker.Path()), INFO, false)
+	}
+}
+
+// saveState writes the state store, logging instead of failing: losing it
+// only costs a re-check on the next start.
+func (e *syncEngine) saveState() {
+	if err := e.state.save(); err != nil {
+		e.log(fmt.Sprintf("Failed to save sync state: %v", err), WARN, false)
+	}
+}
+
+// isInternal reports whether p is one of gofilesync's own files: a transfer
+// temp file, or the state store when the config sits inside LocalPath.
+func (e *syncEngine) isInternal(p string) bool {
+	if isTempName(filepath.Base(p)) {
+		return true
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	state, err := filepath.Abs(e.statePath)
+	if err != nil {
+		return false
+	}
+	return abs == state || abs == state+stateTempSuffix
+}
+
+// remotePathFor maps a path relative to LocalPath onto RemotePath. SFTP paths
+// always use forward slashes, whatever the local OS.
+func (e *syncEngine) remotePathFor(rel string) string {
+	return path.Join(e.cfg.RemotePath, filepath.ToSlash(rel))
+}
+
+// --- Remote Changes ---
+
+// pullTree lists RemotePath recursively and brings remote changes into
+// LocalPath. In bidirectional mode files that changed on both sides are
+// resolved by the conflict policy and files deleted remotely are deleted
+// locally. In pull mode LocalPath is a mirror: the remote copy always wins,
+// and files deleted remotely are only deleted locally with DeleteLocal.
+func (e *syncEngine) pullTree(ctx context.Context) error {
+	mode, _ := e.mode()
+	e.log(fmt.Sprintf("Scanning remote %s", e.cfg.RemotePath), DEBUG, false)
+	seen := make(map[string]bool)
+	var unreadable []string
+	var downloaded, conflicts atomic.Int64
+	deleted := 0
+
+	// The listing is walked here; the files it turns up are fetched by the
+	// transfer workers.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(e.maxTransfers())
+	walker := e.remote().Walk(e.cfg.RemotePath)
+	for walker.Step() {
+		if gctx.Err() != nil {
+			break
+		}
+		rel, ok := e.remoteRel(walker.Path())
+		if err := walker.Err(); err != nil {
+			e.log(fmt.Sprintf("Skipping remote %s: %v", walker.Path(), err), WARN, false)
+			if ok {
+				unreadable = append(unreadable, rel)
+			}
+			continue
+		}
+		if !ok || rel == "." {
+			continue
+		}
+		rinfo := walker.Stat()
+		if rinfo.IsDir() {
+			if err := os.MkdirAll(filepath.Join(e.cfg.LocalPath, rel), 0755); err != nil {
+				if err := e.skipFailed(ctx, rel, fmt.Errorf("failed to create local directory: %w", err)); err != nil {
+					return err
+				}
+				// Keep local files below it rather than take them for deleted.
+				unreadable = append(unreadable, rel)
+				walker.SkipDir()
+			}
+			continue
+		}
+		if !rinfo.Mode().IsRegular() || isTempName(rinfo.Name()) {
+			continue
+		}
+		seen[filepath.ToSlash(rel)] = true
+		g.Go(func() error {
+			result, err := e.pullFile(rel, rinfo, mode)
+			if err != nil {
+				return e.skipFailed(gctx, rel, err)
+			}
+			switch result {
+			case pullDownloaded:
+				downloaded.Add(1)
+			case pullConflict:
+				conflicts.Add(1)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if e.offline() {
+		// Listings that failed look like empty directories; never delete
+		// local files on the strength of a walk that was cut short.
+		return fmt.Errorf("connection to %s:%d lost while scanning remote", e.cfg.Host, e.cfg.Port)
+	}
+
+	if (mode == modeBidirectional || e.cfg.DeleteLocal) && len(seen) == 0 && len(e.state.tree(".")) > 0 {
+		// Everything vanishing at once is far more likely to be a wrong
+		// remote_path or a listing gone bad than a real deletion.
+		e.log(fmt.Sprintf("Remote %s lists no files but earlier syncs recorded some; not deleting anything locally", e.cfg.RemotePath), WARN, false)
+	} else if mode == modeBidirectional || e.cfg.DeleteLocal {
+		for key, prev := range e.state.tree(".") {
+			if seen[key] || underAny(key, unreadable) {
+				continue
+			}
+			removed, err := e.removeLocal(filepath.FromSlash(key), prev, mode)
+			if err != nil {
+				if err := e.skipFailed(ctx, key, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if removed {
+				deleted++
+			}
+		}
+	}
+	e.log(fmt.Sprintf("Remote scan complete: %d downloaded, %d conflicts, %d deleted locally", downloaded.Load(), conflicts.Load(), deleted), DEBUG, false)
+	return nil
+}
+
+// Outcomes of pullFile.
+const (
+	pullUnchanged = iota
+	pullDownloaded
+	pullConflict
+)
+
+// pullFile downloads rel if the remote copy changed since the last sync.
+func (e *syncEngine) pullFile(rel string, rinfo fs.FileInfo, mode string) (int, error) {
+	prev, known := e.state.get(rel)
+	if known && !remoteChanged(prev, rinfo) {
+		return pullUnchanged, nil
+	}
+	localFile := filepath.Join(e.cfg.LocalPath, rel)
+	info, err := os.Lstat(localFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return pullUnchanged, err
+		}
+		// Missing locally: new remotely, or deleted here but changed there,
+		// in which case the remote edit is kept rather than lost.
+		return pullDownloaded, e.download(rel, rinfo)
+	}
+	if !info.Mode().IsRegular() {
+		e.log(fmt.Sprintf("Skipping remote %s: local path is not a regular file", rel), WARN, false)
+		return pullUnchanged, nil
+	}
+	if mode == modePull {
+		return pullDownloaded, e.download(rel, rinfo)
+	}
+
+	changed, hash, err := e.localChanged(rel, info, prev, known)
+	if err != nil {
+		return pullUnchanged, err
+	}
+	if !known && !changed {
+		// Same file on both sides already, just not recorded yet.
+		e.state.put(rel, fileState{Size: info.Size(), ModTime: info.ModTime(), Hash: hash, RemoteModTime: rinfo.ModTime()})
+		return pullUnchanged, nil
+	}
+	if changed {
+		return pullConflict, e.resolveConflict(rel, info, rinfo)
+	}
+	return pullDownloaded, e.download(rel, rinfo)
+}
+
+// localChanged reports whether the local file differs from what was last
+// synced. For files without a state entry it compares against the remote
+// copy's size and mtime instead. The local hash is returned when computed.
+func (e *syncEngine) localChanged(rel string, info fs.FileInfo, prev fileState, known bool) (bool, string, error) {
+	if !known {
+		rinfo, err := e.remote().Stat(e.remotePathFor(rel))
+		if err != nil {
+			return true, "", nil
+		}
+		if rinfo.Size() != info.Size() || !rinfo.ModTime().Equal(info.ModTime().Truncate(time.Second)) {
+			return true, "", nil
+		}
+		hash, err := hashFile(filepath.Join(e.cfg.LocalPath, rel))
+		return false, hash, err
+	}
+	if prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		return false, prev.Hash, nil
+	}
+	if prev.Size != info.Size() {
+		return true, "", nil
+	}
+	hash, err := hashFile(filepath.Join(e.cfg.LocalPath, rel))
+	if err != nil {
+		return false, "", err
+	}
+	return hash != prev.Hash, hash, nil
+}
+
+// remoteChanged reports whether rinfo differs from the remote copy recorded
+// at the last sync.
+func remoteChanged(prev fileState, rinfo fs.FileInfo) bool {
+	return prev.Size != rinfo.Size() || !prev.RemoteModTime.Equal(rinfo.ModTime())
+}
+
+// resolveConflict settles a file that changed both locally and remotely
+// since the last sync, according to Config.ConflictPolicy.
+func (e *syncEngine) resolveConflict(rel string, info, rinfo fs.FileInfo) error {
+	policy, _ := e.conflictPolicy()
+	e.log(fmt.Sprintf("Conflict on %s: changed locally and remotely since the last sync, resolving with policy %q", rel, policy), WARN, false)
+
+	useRemote := false
+	switch policy {
+	case conflictNewest:
+		useRemote = rinfo.ModTime().After(info.ModTime())
+	case conflictRemote:
+		useRemote = true
+	case conflictKeepBoth:
+		// The remote version is set aside under a new local name, which is
+		// then uploaded like any other new file; the local version wins the
+		// original name on both sides.
+		host := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(e.cfg.Host)
+		copyRel := fmt.Sprintf("%s.conflict-%s-%s", rel, host, time.Now().Format("20060102-150405"))
+		if _, err := e.fetch(rel, copyRel, rinfo); err != nil {
+			return fmt.Errorf("failed to keep remote copy of %s: %w", rel, err)
+		}
+		e.log(fmt.Sprintf("Kept remote version of %s as %s", rel, copyRel), INFO, false)
+	}
+	if useRemote {
+		return e.download(rel, rinfo)
+	}
+	hash, err := hashFile(filepath.Join(e.cfg.LocalPath, rel))
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", rel, err)
+	}
+	return e.upload(rel, info, hash)
+}
+
+// removeLocal deletes the local copy of a file that disappeared remotely.
+// In bidirectional mode a file changed locally since the last sync is kept
+// and uploaded again on the next local pass; a pull mirror deletes it
+// regardless. It reports whether it deleted.
+func (e *syncEngine) removeLocal(rel string, prev fileState, mode string) (bool, error) {
+	localFile := filepath.Join(e.cfg.LocalPath, rel)
+	info, err := os.Lstat(localFile)
+	if err != nil {
+		e.state.removeTree(rel)
+		return false, nil
+	}
+	if mode == modeBidirectional {
+		changed, _, err := e.localChanged(rel, info, prev, true)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			e.state.removeTree(rel)
+			e.log(fmt.Sprintf("%s was deleted remotely but changed locally; keeping it", rel), WARN, false)
+			return false, nil
+		}
+	}
+	e.state.removeTree(rel)
+	if err := os.Remove(localFile); err != nil {
+		return false, fmt.Errorf("failed to delete %s locally: %w", rel, err)
+	}
+	e.log(fmt.Sprintf("Deleted %s locally (removed on remote)", rel), INFO, false)
+	e.pruneLocalDirs(filepath.Dir(rel))
+	return true, nil
+}
+
+// pruneLocalDirs removes dir and its parents for as long as they are empty
+// locally and no longer exist remotely.
+func (e *syncEngine) pruneLocalDirs(dir string) {
+	for dir != "." && dir != string(filepath.Separator) {
+		if _, err := e.remote().Stat(e.remotePathFor(dir)); err == nil {
+			return
+		}
+		if err := os.Remove(filepath.Join(e.cfg.LocalPath, dir)); err != nil {
+			return
+		}
+		e.log(fmt.Sprintf("Deleted empty directory %s locally", dir), DEBUG, false)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// download fetches rel from the server into the same local path and
+// records it in the state store.
+func (e *syncEngine) download(rel string, rinfo fs.FileInfo) error {
+	st, err := e.fetch(rel, rel, rinfo)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", rel, err)
+	}
+	e.state.put(rel, st)
+	e.log(fmt.Sprintf("Downloaded %s (%d bytes)", rel, rinfo.Size()), INFO, false)
+	return nil
+}
+
+// fetch copies the remote file rel to localRel, retrying over a new
+// connection if the old one drops; each retry resumes from what was already
+// written locally.
+func (e *syncEngine) fetch(rel, localRel string, rinfo fs.FileInfo) (fileState, error) {
+	var st fileState
+	err := e.transfer("download of "+rel, func() error {
+		var err error
+		st, err = e.fetchOnce(rel, localRel, rinfo)
+		return err
+	})
+	return st, err
+}
+
+// fetchOnce copies the remote file rel to localRel via a temp file, so that
+// neither users nor the watcher see it half written, and returns the state
+// entry describing the result. An interrupted download leaves the temp file
+// behind so that the next attempt can resume it.
+func (e *syncEngine) fetchOnce(rel, localRel string, rinfo fs.FileInfo) (fileState, error) {
+	localFile := filepath.Join(e.cfg.LocalPath, localRel)
+	if err := os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		return fileState{}, err
+	}
+	src, err := e.remote().Open(e.remotePathFor(rel))
+	if err != nil {
+		return fileState{}, err
+	}
+	defer src.Close()
+
+	perm := rinfo.Mode().Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	tmp := tempPathFor(localFile)
+	h := sha256.New()
+	var dst *os.File
+	offset := e.downloadResumeOffset(localRel, tmp, src, rinfo)
+	if offset > 0 {
+		dst, err = os.OpenFile(tmp, os.O_RDWR, perm)
+		if err != nil {
+			return fileState{}, err
+		}
+		// The final hash covers the whole file, including the part that is
+		// already here.
+		if _, err := io.Copy(h, io.NewSectionReader(dst, 0, offset)); err == nil {
+			_, err = dst.Seek(offset, io.SeekStart)
+		}
+		if err == nil {
+			_, err = src.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			dst.Close()
+			return fileState{}, err
+		}
+		e.log(fmt.Sprintf("Resuming download of %s at %d of %d bytes", rel, offset, rinfo.Size()), INFO, false)
+	} else {
+		dst, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return fileState{}, err
+		}
+		if rinfo.Size() >= resumeMinSize {
+			e.state.putPartial(localRel, partialTransfer{Download: true, Size: rinfo.Size(), ModTime: rinfo.ModTime()})
+			e.saveState()
+		}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+		dst.Close()
+		return fileState{}, err
+	}
+	fail := func(err error) (fileState, error) {
+		os.Remove(tmp)
+		e.state.removePartial(localRel)
+		return fileState{}, err
+	}
+	if err := dst.Close(); err != nil {
+		return fail(err)
+	}
+	if err := os.Chtimes(tmp, rinfo.ModTime(), rinfo.ModTime()); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, localFile); err != nil {
+		return fail(err)
+	}
+	e.state.removePartial(localRel)
+	info, err := os.Lstat(localFile)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{Size: info.Size(), ModTime: info.ModTime(), Hash: hex.EncodeToString(h.Sum(nil)), RemoteModTime: rinfo.ModTime()}, nil
+}
+
+// downloadResumeOffset returns where an interrupted download into localRel
+// can carry on, or 0 to start over. The temp file must belong to a download
+// of the same remote file version and match the remote file up to its size.
+func (e *syncEngine) downloadResumeOffset(localRel, tmp string, src *sftp.File, rinfo fs.FileInfo) int64 {
+	partial, ok := e.state.getPartial(localRel)
+	if !ok || !partial.Download || partial.Size != rinfo.Size() || !partial.ModTime.Equal(rinfo.ModTime()) {
+		return 0
+	}
+	local, err := os.Open(tmp)
+	if err != nil {
+		return 0
+	}
+	defer local.Close()
+	tinfo, err := local.Stat()
+	if err != nil || tinfo.Size() == 0 || tinfo.Size() > rinfo.Size() {
+		return 0
+	}
+	if !e.samePrefix(local, src, tinfo.Size()) {
+		e.log(fmt.Sprintf("Partial download of %s does not match the remote file, starting over", localRel), WARN, false)
+		return 0
+	}
+	return tinfo.Size()
+}
+
+// remoteRel maps a remote path below RemotePath back to a local relative
+// path. It reports false for paths outside RemotePath.
+func (e *syncEngine) remoteRel(p string) (string, bool) {
+	root := path.Clean(e.cfg.RemotePath)
+	p = path.Clean(p)
+	if p == root {
+		return ".", true
+	}
+	if root == "." {
+		// A RemotePath relative to the login directory: Walk gives paths
+		// such as "a/b", without a "./" in front.
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return "", false
+		}
+		return filepath.FromSlash(p), true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+	return filepath.FromSlash(strings.TrimPrefix(p, prefix)), true
+}
+
+// tempPathFor returns the hidden temp name used while writing the local file p.
+func tempPathFor(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+tempSuffix)
+}
+
+// tempTarget reverses remoteTempPath, and tempPathFor when given a
+// slash-separated path.
+func tempTarget(p string) string {
+	dir, base := path.Split(p)
+	return dir + strings.TrimSuffix(strings.TrimPrefix(base, "."), tempSuffix)
+}
+
+// remoteTempPath is tempPathFor for slash-separated remote paths.
+func remoteTempPath(p string) string {
+	return path.Join(path.Dir(p), "."+path.Base(p)+tempSuffix)
+}
+
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempSuffix)
+}
+
+// --- Sync State ---
+
+// stateTempSuffix is appended to the state file path while it is rewritten.
+const stateTempSuffix = ".tmp"
+
+// fileState records what a path looked like when it was last uploaded.
+type fileState struct {
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mtime"`
+	Hash          string    `json:"sha256"`
+	RemoteModTime time.Time `json:"remote_mtime"`
+}
+
+// partialTransfer records an upload or download that was interrupted, so
+// its temp file can be resumed. Size and ModTime describe the source file;
+// if the source changed since, the transfer starts over.
+type partialTransfer struct {
+	Download bool      `json:"download,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mtime"`
+}
+
+// syncState is the on-disk manifest of uploaded files, keyed by slash-separated
+// path relative to LocalPath. It lets a restarted engine skip files that have
+// not changed since the previous run.
+type syncState struct {
+	path     string
+	mu       sync.Mutex
+	files    map[string]fileState
+	partials map[string]partialTransfer
+	dirty    bool
+}
+
+type syncStateFile struct {
+	Files    map[string]fileState       `json:"files"`
+	Partials map[string]partialTransfer `json:"partials,omitempty"`
+}
+
+// stateFilePath returns where the state store for configPath lives: next to
+// the config file, e.g. config.json -> config.state.json, or
+// config.photos.state.json for the profile named photos.
+func stateFilePath(configPath, profile string) string {
+	base := strings.TrimSuffix(configPath, filepath.Ext(configPath))
+	if profile != "" {
+		base += "." + profile
+	}
+	return base + ".state.json"
+}
+
+// loadSyncState reads the manifest at p. A missing file yields an empty store.
+func loadSyncState(p string) (*syncState, error) {
+	s := &syncState{path: p, files: make(map[string]fileState), partials: make(map[string]partialTransfer)}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		customPrint(fmt.Sprintf("No sync state at %s, starting fresh", p), DEBUG, false)
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file syncStateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", p, err)
+	}
+	if file.Files != nil {
+		s.files = file.Files
+	}
+	if file.Partials != nil {
+		s.partials = file.Partials
+	}
+	customPrint(fmt.Sprintf("Loaded sync state for %d files from %s", len(s.files), p), DEBUG, false)
+	return s, nil
+}
+
+func (s *syncState) get(rel string) (fileState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.files[filepath.ToSlash(rel)]
+	return st, ok
+}
+
+func (s *syncState) put(rel string, st fileState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[filepath.ToSlash(rel)] = st
+	s.dirty = true
+}
+
+func (s *syncState) getPartial(rel string) (partialTransfer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pt, ok := s.partials[filepath.ToSlash(rel)]
+	return pt, ok
+}
+
+func (s *syncState) putPartial(rel string, pt partialTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partials[filepath.ToSlash(rel)] = pt
+	s.dirty = true
+}
+
+func (s *syncState) removePartial(rel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.partials[filepath.ToSlash(rel)]; ok {
+		delete(s.partials, filepath.ToSlash(rel))
+		s.dirty = true
+	}
+}
+
+// tree returns a copy of the entries for rel itself and everything below it.
+func (s *syncState) tree(rel string) map[string]fileState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := filepath.ToSlash(rel)
+	out := make(map[string]fileState)
+	for k, st := range s.files {
+		if key == "." || k == key || strings.HasPrefix(k, key+"/") {
+			out[k] = st
+		}
+	}
+	return out
+}
+
+// removeTree forgets rel and everything below it.
+func (s *syncState) removeTree(rel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := filepath.ToSlash(rel)
+	for k := range s.files {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(s.files, k)
+			s.dirty = true
+		}
+	}
+}
+
+// rename moves the entries for oldRel and everything below it to newRel.
+func (s *syncState) rename(oldRel, newRel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldKey, newKey := filepath.ToSlash(oldRel), filepath.ToSlash(newRel)
+	moved := make(map[string]fileState)
+	for k, st := range s.files {
+		if k == oldKey || strings.HasPrefix(k, oldKey+"/") {
+			delete(s.files, k)
+			moved[newKey+strings.TrimPrefix(k, oldKey)] = st
+		}
+	}
+	for k, st := range moved {
+		s.files[k] = st
+		s.dirty = true
+	}
+}
+
+// save writes the manifest if it changed, via a temp file and rename so a
+// crash never leaves a truncated store behind.
+func (s *syncState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(syncStateFile{Files: s.files, Partials: s.partials}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + stateTempSuffix
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// samePrefix reports whether the local and the remote file hold the same
+// first n bytes, by SHA-256 over all of them. The server hashes its side
+// when it offers the check-file extension; otherwise the remote bytes are
+// read back, which still beats sending a damaged prefix on.
+func (e *syncEngine) samePrefix(local io.ReaderAt, remote *sftp.File, n int64) bool {
+	want, err := hashPrefix(local, n)
+	if err != nil {
+		return false
+	}
+	var got []byte
+	if _, ok := e.remote().HasExtension("check-file"); ok {
+		if got, err = e.checkFile(remote.Name(), n); err != nil {
+			e.log(fmt.Sprintf("check-file on %s failed, reading it back instead: %v", remote.Name(), err), DEBUG, false)
+		}
+	}
+	if got == nil {
+		if got, err = hashPrefix(remote, n); err != nil {
+			return false
+		}
+	}
+	return bytes.Equal(want, got)
+}
+
+// hashPrefix returns the SHA-256 of the first n bytes of r.
+func hashPrefix(r io.ReaderAt, n int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, n)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// SFTP packet types used by checkFile.
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+)
+
+// checkFile has the server hash the first n bytes of the remote file p with
+// the check-file-name request (draft-ietf-secsh-filexfer-extensions). The
+// SFTP client library cannot send it, so it goes over a session of its own.
+func (e *syncEngine) checkFile(p string, n int64) ([]byte, error) {
+	e.connMu.RLock()
+	conn := e.conn
+	e.connMu.RUnlock()
+	if conn == nil {
+		return nil, errors.New("not connected")
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+	if err := writeSFTPPacket(w, sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	if typ, _, err := readSFTPPacket(r); err != nil {
+		return nil, err
+	} else if typ != sshFxpVersion {
+		return nil, fmt.Errorf("unexpected packet type %d", typ)
+	}
+	req := binary.BigEndian.AppendUint32(nil, 1) // request id
+	for _, field := range []string{"check-file-name", p, "sha256"} {
+		req = binary.BigEndian.AppendUint32(req, uint32(len(field)))
+		req = append(req, field...)
+	}
+	req = binary.BigEndian.AppendUint64(req, 0)         // start offset
+	req = binary.BigEndian.AppendUint64(req, uint64(n)) // length
+	req = binary.BigEndian.AppendUint32(req, 0)         // one hash for the whole range
+	if err := writeSFTPPacket(w, sshFxpExtended, req); err != nil {
+		return nil, err
+	}
+	typ, data, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case typ == sshFxpStatus && len(data) >= 8:
+		return nil, fmt.Errorf("server returned status %d", binary.BigEndian.Uint32(data[4:]))
+	case typ != sshFxpExtendedReply || len(data) < 8:
+		return nil, fmt.Errorf("unexpected packet type %d", typ)
+	}
+	// Reply: request id, hash algorithm, then the hash itself.
+	algLen := int(binary.BigEndian.Uint32(data[4:]))
+	if len(data) < 8+algLen || string(data[8:8+algLen]) != "sha256" {
+		return nil, errors.New("server did not hash with sha256")
+	}
+	sum := data[8+algLen:]
+	if len(sum) != sha256.Size {
+		return nil, fmt.Errorf("unexpected hash length %d", len(sum))
+	}
+	return sum, nil
+}
+
+// writeSFTPPacket sends one SFTP packet: length, type and payload.
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := w.Write(append(packet, payload...))
+	return err
+}
+
+// readSFTPPacket reads one SFTP packet and returns its type and payload.
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > 1<<18 {
+		return 0, nil, fmt.Errorf("bad packet length %d", size)
+	}
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestEngine returns an engine connected to an in-process SFTP server
+// whose login directory is remoteDir.
+func newTestEngine(t *testing.T, cfg *Config, remoteDir string) *syncEngine {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn, sftp.WithServerWorkingDirectory(remoteDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	e := newSyncEngine(cfg, filepath.Join(t.TempDir(), "state.json"))
+	if e.state, err = loadSyncState(e.statePath); err != nil {
+		t.Fatal(err)
+	}
+	e.client, e.clientDone = client, make(chan struct{})
+	return e
+}
+
+func writeTestFile(t *testing.T, p, data string) {
+	t.Helper()
+	if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteRel(t *testing.T) {
+	tests := []struct {
+		root, p, want string
+		ok            bool
+	}{
+		{"/srv/data", "/srv/data", ".", true},
+		{"/srv/data", "/srv/data/a/b", filepath.FromSlash("a/b"), true},
+		{"/srv/data/", "/srv/data/a", "a", true},
+		{"/srv/data", "/srv/database/a", "", false},
+		{"/", "/a", "a", true},
+		{".", ".", ".", true},
+		{".", "a/b", filepath.FromSlash("a/b"), true},
+		{"", "a", "a", true},
+		{".", "../a", "", false},
+		{".", "/a", "", false},
+		{"sub", "sub/a", "a", true},
+		{"sub", "a", "", false},
+	}
+	for _, tt := range tests {
+		e := &syncEngine{cfg: &Config{RemotePath: tt.root}}
+		got, ok := e.remoteRel(tt.p)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("remoteRel(%q) with remote_path %q = %q, %v; want %q, %v", tt.p, tt.root, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// A remote_path of "." used to match no listed file, so a bidirectional
+// poll took every synced file for deleted remotely and removed it locally.
+func TestPullTreeRelativeRemotePathKeepsFiles(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(local, "keep.txt"), "keep")
+	e := newTestEngine(t, &Config{LocalPath: local, RemotePath: ".", Mode: modeBidirectional}, remote)
+	ctx := context.Background()
+
+	if err := e.syncTree(ctx, "."); err != nil {
+		t.Fatalf("syncTree: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "keep.txt")); err != nil {
+		t.Fatalf("keep.txt was not uploaded: %v", err)
+	}
+	if err := e.pullTree(ctx); err != nil {
+		t.Fatalf("pullTree: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "keep.txt")); err != nil {
+		t.Fatalf("keep.txt was deleted locally: %v", err)
+	}
+}
+
+func TestPullTreeEmptyListingDeletesNothing(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(local, "keep.txt"), "keep")
+	e := newTestEngine(t, &Config{LocalPath: local, RemotePath: remote, Mode: modeBidirectional}, remote)
+	ctx := context.Background()
+
+	if err := e.syncTree(ctx, "."); err != nil {
+		t.Fatalf("syncTree: %v", err)
+	}
+	if err := os.Remove(filepath.Join(remote, "keep.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pullTree(ctx); err != nil {
+		t.Fatalf("pullTree: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "keep.txt")); err != nil {
+		t.Fatalf("keep.txt was deleted locally after an empty listing: %v", err)
+	}
+}
+
+func TestPullTreeDeletesRemovedFile(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(local, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(local, "gone.txt"), "gone")
+	e := newTestEngine(t, &Config{LocalPath: local, RemotePath: ".", Mode: modeBidirectional}, remote)
+	ctx := context.Background()
+
+	if err := e.syncTree(ctx, "."); err != nil {
+		t.Fatalf("syncTree: %v", err)
+	}
+	if err := os.Remove(filepath.Join(remote, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pullTree(ctx); err != nil {
+		t.Fatalf("pullTree: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("gone.txt was not deleted locally: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "keep.txt")); err != nil {
+		t.Errorf("keep.txt was deleted locally: %v", err)
+	}
+}
+
+// One file that cannot be uploaded must not stop the pass for the rest.
+func TestSyncTreeSkipsFailedFile(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "f.txt"} {
+		writeTestFile(t, filepath.Join(local, name), name)
+	}
+	// A directory where a.txt should go makes its upload fail.
+	if err := os.MkdirAll(filepath.Join(remote, "a.txt", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEngine(t, &Config{LocalPath: local, RemotePath: remote, MaxConcurrentTransfers: 1}, remote)
+
+	if err := e.syncTree(context.Background(), "."); err != nil {
+		t.Fatalf("syncTree: %v", err)
+	}
+	for _, name := range []string{"b.txt", "c.txt", "d.txt", "e.txt", "f.txt"} {
+		if _, err := os.Stat(filepath.Join(remote, name)); err != nil {
+			t.Errorf("%s was not uploaded: %v", name, err)
+		}
+	}
+	if _, ok := e.state.get("a.txt"); ok {
+		t.Error("a.txt is recorded as synced")
+	}
+}
+
+// Damage anywhere in a partial file, not only near its end, must stop it
+// from being resumed.
+func TestSamePrefixChecksWholePrefix(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	localPath := filepath.Join(local, "big.bin")
+	writeTestFile(t, localPath, string(data))
+	partial := data[:2<<20]
+	writeTestFile(t, filepath.Join(remote, "intact.tmp"), string(partial))
+	damaged := append([]byte{partial[0] ^ 0xff}, partial[1:]...)
+	writeTestFile(t, filepath.Join(remote, "damaged.tmp"), string(damaged))
+	e := newTestEngine(t, &Config{LocalPath: local, RemotePath: remote}, remote)
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for name, want := range map[string]bool{"intact.tmp": true, "damaged.tmp": false} {
+		f, err := e.remote().Open(filepath.Join(remote, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.samePrefix(src, f, int64(len(partial))); got != want {
+			t.Errorf("samePrefix with %s = %v, want %v", name, got, want)
+		}
+		f.Close()
+	}
+}
+
+// Small files are not worth resuming, so uploading them must not rewrite
+// the state file once per file, which made a large initial sync quadratic.
+func TestSmallUploadsDoNotSaveState(t *testing.T) {
+	local, remote := t.TempDir(), t.TempDir()
+	for i := range 50 {
+		writeTestFile(t, filepath.Join(local, fmt.Sprintf("f%02d.txt", i)), "x")
+	}
+	e := newTestEngine(t, &Config{LocalPath: local, RemotePath: remote}, remote)
+
+	if err := e.syncTree(context.Background(), "."); err != nil {
+		t.Fatalf("syncTree: %v", err)
+	}
+	if _, err := os.Stat(e.statePath); !os.IsNotExist(err) {
+		t.Errorf("state file was written during the pass: %v", err)
+	}
+	if _, ok := e.state.get("f49.txt"); !ok {
+		t.Error("f49.txt is not recorded as synced")
+	}
+}